@@ -8,7 +8,7 @@ import (
 	"path/filepath"
 
 	_ "github.com/lib/pq" // imported for side-effects only, not for direct use in the code.
-	"github.com/oschwald/geoip2-golang"
+	"github.com/mvavassori/flockcounter/utils"
 )
 
 func CreatePostgresConnection() (*sql.DB, error) {
@@ -35,22 +35,48 @@ func CreatePostgresConnection() (*sql.DB, error) {
 	return db, nil
 }
 
-func CreateGeoIPConnection() (*geoip2.Reader, error) {
-	dbPath := os.Getenv("GEOIP_DB_PATH")
-	if dbPath == "" {
-		// Fallback to local development path if env var not set
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return nil, fmt.Errorf("home directory error: %w", err)
+// CreateGeolocator sets up the geolocation provider chosen with GEOLOCATION_PROVIDER (maxmind by default). The maxmind and mmdb providers open the database at GEOIP_DB_PATH, which can be reloaded while the server runs.
+func CreateGeolocator() (utils.Geolocator, error) {
+	provider := os.Getenv("GEOLOCATION_PROVIDER")
+
+	var dbPath string
+	if provider == "" || provider == utils.GeolocationMaxMind || provider == utils.GeolocationMMDB {
+		dbPath = os.Getenv("GEOIP_DB_PATH")
+		if dbPath == "" {
+			// Fallback to local development path if env var not set
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("home directory error: %w", err)
+			}
+			dbPath = filepath.Join(homeDir, ".geoip2", "GeoLite2-City.mmdb")
 		}
-		dbPath = filepath.Join(homeDir, ".geoip2", "GeoLite2-City.mmdb")
 	}
 
-	db, err := geoip2.Open(dbPath)
+	geolocator, err := utils.NewGeolocator(provider, dbPath, os.Getenv("GEOLOCATION_COUNTRY_HEADER"))
 	if err != nil {
-		return nil, fmt.Errorf("geoip connection error: %w", err)
+		return nil, fmt.Errorf("geolocation error: %w", err)
 	}
 
-	log.Println("Successfully connected to GeoIP Database")
-	return db, nil
+	if dbPath != "" {
+		log.Println("Successfully connected to GeoIP Database")
+	} else {
+		log.Printf("Using the %s geolocation provider", provider)
+	}
+	return geolocator, nil
+}
+
+// CreateASNDatabase opens the optional ASN database at GEOIP_ASN_DB_PATH (e.g. GeoLite2-ASN.mmdb), which records the network of the visitors and flags the datacenter ones. It returns nil if the variable isn't set.
+func CreateASNDatabase() (*utils.GeoIPDatabase, error) {
+	dbPath := os.Getenv("GEOIP_ASN_DB_PATH")
+	if dbPath == "" {
+		return nil, nil
+	}
+
+	asnDB, err := utils.OpenASNDatabase(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("ASN database error: %w", err)
+	}
+
+	log.Println("Successfully connected to ASN Database")
+	return asnDB, nil
 }
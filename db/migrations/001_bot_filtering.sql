@@ -0,0 +1,11 @@
+-- Per website switch to keep bot traffic instead of discarding it at ingest
+ALTER TABLE websites ADD COLUMN keep_bots BOOLEAN NOT NULL DEFAULT false;
+
+-- Daily counters of the hits discarded at ingest, per website and reason (e.g. 'bot')
+CREATE TABLE filtered_hits (
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    date DATE NOT NULL,
+    reason TEXT NOT NULL,
+    count INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (website_id, date, reason)
+);
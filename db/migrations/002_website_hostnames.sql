@@ -0,0 +1,16 @@
+-- Extra hostnames a website accepts hits from besides its registered domain and its www. counterpart.
+-- Either an exact hostname (staging.example.com) or a wildcard covering every subdomain (*.example.com).
+CREATE TABLE website_hostnames (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    hostname TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX website_hostnames_website_id_idx ON website_hostnames (website_id);
+
+-- Hostname the visit was sent from, used to break down the traffic of a website by subdomain
+ALTER TABLE visits ADD COLUMN hostname TEXT;
+
+-- Backfill from the page url of the existing visits
+UPDATE visits SET hostname = LOWER(SUBSTRING(url FROM '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^/@]*@)?([^/:?#]+)')) WHERE hostname IS NULL;
@@ -0,0 +1,13 @@
+-- Keys authenticating server-side visits and events of a website. Only the SHA-256 hash of the key is stored.
+CREATE TABLE ingest_keys (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    key_prefix TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX ingest_keys_website_id_idx ON ingest_keys (website_id);
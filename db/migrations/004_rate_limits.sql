@@ -0,0 +1,9 @@
+-- Token buckets of the rate limiter when RATE_LIMIT_STORE=postgres, shared by every backend replica
+CREATE TABLE rate_limit_buckets (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    allowed BOOLEAN NOT NULL, -- whether the last request took a token
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX rate_limit_buckets_updated_at_idx ON rate_limit_buckets (updated_at);
@@ -0,0 +1,11 @@
+-- Per website rules discarding the visits and events of spam referrers, on top of the bundled referrer spam list.
+-- exact and suffix rules match the referrer host, regex rules the referrer host and path.
+CREATE TABLE referrer_block_rules (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    rule_type TEXT NOT NULL CHECK (rule_type IN ('exact', 'suffix', 'regex')),
+    pattern TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX referrer_block_rules_website_id_idx ON referrer_block_rules (website_id);
@@ -0,0 +1,7 @@
+-- Traffic channel of the visit (Direct, Organic Search, Paid Search, Social, Email, Referral, Campaign), classified at ingest
+ALTER TABLE visits ADD COLUMN channel TEXT;
+
+-- Visits without referrer and UTM tags are unambiguously Direct. The channel of the other existing visits is left empty, classifying them would need the ingest rules.
+UPDATE visits SET channel = 'Direct'
+WHERE channel IS NULL AND referrer = 'Direct'
+    AND utm_source IS NULL AND utm_medium IS NULL AND utm_campaign IS NULL;
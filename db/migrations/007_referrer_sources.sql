@@ -0,0 +1,10 @@
+-- Friendly name of the referrer (Google, Facebook, Hacker News, ...) resolved at ingest from the bundled mapping in utils/data/referrer_sources.json
+ALTER TABLE visits ADD COLUMN referrer_source TEXT;
+
+-- Existing visits get their referrer host (without www.) as source, only new visits are mapped to friendly names
+UPDATE visits
+SET referrer_source = CASE
+    WHEN referrer = 'Direct' THEN 'Direct'
+    ELSE REGEXP_REPLACE(LOWER(SPLIT_PART(referrer, '/', 1)), '^www\.', '')
+END
+WHERE referrer_source IS NULL;
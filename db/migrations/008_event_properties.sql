@@ -0,0 +1,7 @@
+-- Custom properties attached to events, a flat object of string keys and values
+ALTER TABLE events ADD COLUMN properties JSONB NOT NULL DEFAULT '{}';
+
+-- Daily hashed visitor identifier (the same one stored in daily_unique_identifiers), used to count unique visitors per property value. It rotates with the daily salt, so it can't link visits across days.
+ALTER TABLE events ADD COLUMN visitor_id TEXT;
+
+CREATE INDEX idx_events_properties ON events USING GIN (properties);
@@ -0,0 +1,17 @@
+-- Conversion goals of a website: pageviews of a pathname pattern (* is a wildcard) or events with a name and optionally a property value
+CREATE TABLE goals (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    goal_type TEXT NOT NULL CHECK (goal_type IN ('pageview', 'event')),
+    pathname TEXT NOT NULL DEFAULT '',
+    event_name TEXT NOT NULL DEFAULT '',
+    property_key TEXT NOT NULL DEFAULT '',
+    property_value TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_goals_website_id ON goals (website_id);
+
+-- Daily hashed visitor identifier of the visit, like events.visitor_id, used to count unique converters. Visits stored before this migration have none and don't count as converters.
+ALTER TABLE visits ADD COLUMN visitor_id TEXT;
@@ -0,0 +1,15 @@
+-- Ordered funnels of a website, steps is a JSON array of {"type": "pageview", "pathname": "/pricing"} or {"type": "event", "eventName": "signup_completed"}
+CREATE TABLE funnels (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    steps JSONB NOT NULL,
+    window_minutes INTEGER NOT NULL DEFAULT 60 CHECK (window_minutes BETWEEN 1 AND 1440),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_funnels_website_id ON funnels (website_id);
+
+-- Funnel steps and goal converters are linked by visitor
+CREATE INDEX idx_visits_visitor_id ON visits (visitor_id);
+CREATE INDEX idx_events_visitor_id ON events (visitor_id);
@@ -0,0 +1,19 @@
+-- Sessions group the pageviews of a visitor (by daily hashed identifier) separated by less than the inactivity timeout. They are built at ingest, visits stored before this migration have no session.
+CREATE TABLE sessions (
+    id BIGSERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    website_domain TEXT NOT NULL,
+    visitor_id TEXT NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL,
+    last_seen_at TIMESTAMPTZ NOT NULL,
+    entry_page TEXT NOT NULL,
+    exit_page TEXT NOT NULL,
+    pageviews INTEGER NOT NULL DEFAULT 1,
+    duration INTEGER NOT NULL DEFAULT 0 -- seconds from the start of the first pageview to the end of the last one
+);
+
+CREATE INDEX idx_sessions_visitor ON sessions (website_id, visitor_id, last_seen_at);
+CREATE INDEX idx_sessions_domain_started_at ON sessions (website_domain, started_at);
+
+ALTER TABLE visits ADD COLUMN session_id BIGINT;
+CREATE INDEX idx_visits_session_id ON visits (session_id);
@@ -0,0 +1,7 @@
+-- Core Web Vitals of the page load, only set on the pageviews the tracker measured them for. CLS is unitless, the others are in milliseconds.
+ALTER TABLE visits
+    ADD COLUMN lcp DOUBLE PRECISION,
+    ADD COLUMN cls DOUBLE PRECISION,
+    ADD COLUMN inp DOUBLE PRECISION,
+    ADD COLUMN fcp DOUBLE PRECISION,
+    ADD COLUMN ttfb DOUBLE PRECISION;
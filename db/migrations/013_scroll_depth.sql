@@ -0,0 +1,2 @@
+-- Maximum scroll depth reached on the page, in percent (0-100). NULL for visits sent without it.
+ALTER TABLE visits ADD COLUMN scroll_depth SMALLINT CHECK (scroll_depth BETWEEN 0 AND 100);
@@ -0,0 +1,21 @@
+-- Per website pathname normalization, applied at ingest before the pathname is stored
+ALTER TABLE websites
+    ADD COLUMN lowercase_paths BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN strip_trailing_slash BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN collapse_index BOOLEAN NOT NULL DEFAULT false;
+
+-- Ordered regex rewrites of the pathname (e.g. /users/\d+ -> /users/:id), run after the settings above
+CREATE TABLE pathname_rewrite_rules (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    pattern TEXT NOT NULL,
+    replacement TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_pathname_rewrite_rules_website_id ON pathname_rewrite_rules (website_id, position);
+
+-- Reapplying the rules updates every row of a pathname at once
+CREATE INDEX idx_visits_website_id_pathname ON visits (website_id, pathname);
+CREATE INDEX idx_events_website_id_pathname ON events (website_id, pathname);
@@ -0,0 +1,2 @@
+-- Single-page apps routing with the url fragment: the page path is taken from #/path instead of the pathname
+ALTER TABLE websites ADD COLUMN hash_routing BOOLEAN NOT NULL DEFAULT false;
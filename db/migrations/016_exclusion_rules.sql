@@ -0,0 +1,11 @@
+-- Per website rules discarding internal traffic at ingest: ip rules are CIDR ranges matched against the visitor ip,
+-- pathname rules are patterns where * matches any characters, hostname rules match the page hostname (*.example.com for subdomains).
+CREATE TABLE exclusion_rules (
+    id SERIAL PRIMARY KEY,
+    website_id INTEGER NOT NULL REFERENCES websites(id) ON DELETE CASCADE,
+    rule_type TEXT NOT NULL CHECK (rule_type IN ('ip', 'pathname', 'hostname')),
+    pattern TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX exclusion_rules_website_id_idx ON exclusion_rules (website_id);
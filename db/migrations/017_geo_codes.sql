@@ -0,0 +1,11 @@
+-- ISO 3166-1 alpha-2 country code, ISO 3166-2 subdivision code (e.g. IT-25) and continent code (e.g. EU) of the visitor.
+-- NULL when the location is unknown and for the visits and events stored before they were collected.
+ALTER TABLE visits
+    ADD COLUMN country_code TEXT,
+    ADD COLUMN region_code TEXT,
+    ADD COLUMN continent TEXT;
+
+ALTER TABLE events
+    ADD COLUMN country_code TEXT,
+    ADD COLUMN region_code TEXT,
+    ADD COLUMN continent TEXT;
@@ -0,0 +1,21 @@
+-- GeoNames IDs of the country, region and city of the visitor, as found in the MaxMind (and compatible) databases.
+-- NULL when the location is unknown, when the geolocation provider doesn't return them (e.g. CDN headers)
+-- and for the visits and events stored before they were collected.
+ALTER TABLE visits
+    ADD COLUMN country_geoname_id INTEGER,
+    ADD COLUMN region_geoname_id INTEGER,
+    ADD COLUMN city_geoname_id INTEGER;
+
+ALTER TABLE events
+    ADD COLUMN country_geoname_id INTEGER,
+    ADD COLUMN region_geoname_id INTEGER,
+    ADD COLUMN city_geoname_id INTEGER;
+
+-- Localized names of the GeoNames IDs above, one row per locale (de, en, es, fr, ja, pt-BR, ru, zh-CN).
+-- The dashboard resolves the names in the locale of the user, falling back to the English name stored with the hit.
+CREATE TABLE geo_names (
+    geoname_id INTEGER NOT NULL,
+    locale TEXT NOT NULL,
+    name TEXT NOT NULL,
+    PRIMARY KEY (geoname_id, locale)
+);
@@ -0,0 +1,15 @@
+-- Autonomous system of the visitor, looked up in the optional ASN database (GEOIP_ASN_DB_PATH).
+-- NULL without an ASN database and for the visits and events stored before it was collected.
+-- is_datacenter flags the ASNs of cloud, hosting and datacenter providers.
+ALTER TABLE visits
+    ADD COLUMN asn INTEGER,
+    ADD COLUMN asn_organization TEXT,
+    ADD COLUMN is_datacenter BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE events
+    ADD COLUMN asn INTEGER,
+    ADD COLUMN asn_organization TEXT,
+    ADD COLUMN is_datacenter BOOLEAN NOT NULL DEFAULT false;
+
+-- Per website switch to discard datacenter traffic (counted in filtered_hits as 'datacenter') instead of storing it flagged
+ALTER TABLE websites ADD COLUMN exclude_datacenter BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+-- Browser and operating system versions, taken from the User-Agent Client Hints when the browser sends them
+-- (e.g. 11 for Windows 11, which still sends Windows NT 10.0 in its user agent string), and the screen width bucket
+-- sent by the tracker (e.g. 1440-1919px). NULL when unknown and for the visits stored before they were collected.
+ALTER TABLE visits
+    ADD COLUMN os_version TEXT,
+    ADD COLUMN browser_version TEXT,
+    ADD COLUMN screen_size TEXT;
@@ -18,11 +18,12 @@ require (
 
 require (
 	github.com/felixge/httpsnoop v1.0.4 // indirect
-	github.com/oschwald/maxminddb-golang v1.13.1 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 )
 
 require (
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/gorilla/handlers v1.5.2
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/net v0.21.0
 )
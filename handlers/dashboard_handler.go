@@ -10,9 +10,11 @@ import (
 
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/mvavassori/flockcounter/utils"
 )
 
@@ -55,10 +57,13 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 		var uniqueVisitors []map[string]interface{}
 		var medianVisitDuration []map[string]interface{}
 
+		var sessionStats []map[string]interface{}
+
 		var totalVisitsAggregate int
 		var uniqueVisitorsAggregate int
 		var medianVisitDurationAggregate float64
 		var visitPeriodsCount int
+		var sessionsAggregate, bouncesAggregate, sessionPageviewsAggregate, sessionDurationAggregate int
 
 		// Generate a list of all periods in the range
 		periods := make([]time.Time, 0)
@@ -93,14 +98,19 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -191,14 +201,19 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 			// Map query parameter names to column names
 			filters := map[string]string{
 				"referrer":     "referrer",
+				"source":       "referrer_source",
 				"pathname":     "pathname",
+				"hostname":     "hostname",
+				"channel":      "channel",
 				"device_type":  "device_type",
 				"os":           "os",
 				"browser":      "browser",
 				"language":     "language",
 				"country":      "country",
 				"city":         "city",
+				"city_id":      "city_geoname_id::text",
 				"region":       "region",
+				"region_id":    "region_geoname_id::text",
 				"utm_source":   "utm_source",
 				"utm_medium":   "utm_medium",
 				"utm_campaign": "utm_campaign",
@@ -285,14 +300,19 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 			// Map query parameter names to column names
 			filters := map[string]string{
 				"referrer":     "referrer",
+				"source":       "referrer_source",
 				"pathname":     "pathname",
+				"hostname":     "hostname",
+				"channel":      "channel",
 				"device_type":  "device_type",
 				"os":           "os",
 				"browser":      "browser",
 				"language":     "language",
 				"country":      "country",
 				"city":         "city",
+				"city_id":      "city_geoname_id::text",
 				"region":       "region",
+				"region_id":    "region_geoname_id::text",
 				"utm_source":   "utm_source",
 				"utm_medium":   "utm_medium",
 				"utm_campaign": "utm_campaign",
@@ -396,6 +416,118 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 			mu.Unlock()
 		}()
 
+		// Goroutine 4: Sessions, for bounce rate, views per session and session duration
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Sessions are counted in the period they started in
+			baseQuery := fmt.Sprintf(`
+		SELECT DATE_TRUNC('%s', started_at) AS period, COUNT(*), COUNT(*) FILTER (WHERE pageviews = 1), SUM(pageviews), SUM(duration)
+		FROM sessions
+		WHERE website_domain = $1 AND started_at BETWEEN $2 AND $3`, interval)
+			params := []interface{}{domain, start, end}
+			paramIndex := 4
+
+			// Map query parameter names to column names
+			filters := map[string]string{
+				"referrer":     "referrer",
+				"source":       "referrer_source",
+				"pathname":     "pathname",
+				"hostname":     "hostname",
+				"channel":      "channel",
+				"device_type":  "device_type",
+				"os":           "os",
+				"browser":      "browser",
+				"language":     "language",
+				"country":      "country",
+				"city":         "city",
+				"city_id":      "city_geoname_id::text",
+				"region":       "region",
+				"region_id":    "region_geoname_id::text",
+				"utm_source":   "utm_source",
+				"utm_medium":   "utm_medium",
+				"utm_campaign": "utm_campaign",
+				"utm_term":     "utm_term",
+				"utm_content":  "utm_content",
+			}
+
+			// A session matches the filters if one of its visits does
+			visitConditions := ""
+			for param, column := range filters {
+				value := r.URL.Query().Get(param)
+				if value != "" {
+					visitConditions += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+					params = append(params, value)
+					paramIndex++
+				}
+			}
+			if visitConditions != "" {
+				baseQuery += " AND id IN (SELECT session_id FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3" + visitConditions + ")"
+			}
+
+			// Complete the query with grouping and ordering
+			baseQuery += " GROUP BY period ORDER BY period ASC"
+
+			rows, err := db.Query(baseQuery, params...)
+			if err != nil {
+				log.Println("Error getting sessions:", err)
+				return
+			}
+			defer rows.Close()
+
+			var dataPoints []map[string]interface{}
+			for rows.Next() {
+				var period time.Time
+				var sessions, bounces, pageviews, duration int
+				err = rows.Scan(&period, &sessions, &bounces, &pageviews, &duration)
+				if err != nil {
+					log.Println("Error scanning sessions:", err)
+					return
+				}
+				dataPoints = append(dataPoints, map[string]interface{}{
+					"period":          period.Format(time.RFC3339),
+					"sessions":        sessions,
+					"bounceRate":      percentage(bounces, sessions),
+					"viewsPerSession": math.Round(float64(pageviews)/float64(sessions)*100) / 100,
+					"sessionDuration": formatSeconds(float64(duration) / float64(sessions)),
+				})
+				sessionsAggregate += sessions
+				bouncesAggregate += bounces
+				sessionPageviewsAggregate += pageviews
+				sessionDurationAggregate += duration
+			}
+
+			// Fill in missing periods with zero values
+			for _, p := range periods {
+				found := false
+				for _, dp := range dataPoints {
+					if dp["period"] == p.Format(time.RFC3339) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					dataPoints = append(dataPoints, map[string]interface{}{
+						"period":          p.Format(time.RFC3339),
+						"sessions":        0,
+						"bounceRate":      0,
+						"viewsPerSession": 0,
+						"sessionDuration": "0s",
+					})
+				}
+			}
+
+			// Sort data points by period
+			sort.Slice(dataPoints, func(i, j int) bool {
+				return dataPoints[i]["period"].(string) < dataPoints[j]["period"].(string)
+			})
+
+			mu.Lock()
+			sessionStats = dataPoints
+			mu.Unlock()
+		}()
+
 		// Wait for all goroutines to complete
 		wg.Wait()
 
@@ -405,17 +537,14 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Format the median visit duration aggregate in a readable format
-		hours := int(medianVisitDurationAggregate / 3600)
-		minutes := int(math.Mod(medianVisitDurationAggregate, 3600) / 60)
-		seconds := int(math.Mod(medianVisitDurationAggregate, 60))
-
-		var medianVisitDurationAggregateFormatted string
-		if hours > 0 {
-			medianVisitDurationAggregateFormatted = fmt.Sprintf("%dh %dm %ds", hours, minutes, seconds)
-		} else if minutes > 0 {
-			medianVisitDurationAggregateFormatted = fmt.Sprintf("%dm %ds", minutes, seconds)
-		} else {
-			medianVisitDurationAggregateFormatted = fmt.Sprintf("%ds", seconds)
+		medianVisitDurationAggregateFormatted := formatSeconds(medianVisitDurationAggregate)
+
+		var bounceRateAggregate, viewsPerSessionAggregate float64
+		sessionDurationAggregateFormatted := "0s"
+		if sessionsAggregate > 0 {
+			bounceRateAggregate = percentage(bouncesAggregate, sessionsAggregate)
+			viewsPerSessionAggregate = math.Round(float64(sessionPageviewsAggregate)/float64(sessionsAggregate)*100) / 100
+			sessionDurationAggregateFormatted = formatSeconds(float64(sessionDurationAggregate) / float64(sessionsAggregate))
 		}
 
 		// Sort the results by period
@@ -429,11 +558,16 @@ func GetTopStats(db *sql.DB) http.HandlerFunc {
 				"totalVisits":         totalVisits,
 				"uniqueVisitors":      uniqueVisitors,
 				"medianVisitDuration": medianVisitDuration,
+				"sessions":            sessionStats,
 			},
 			"aggregates": map[string]interface{}{
 				"totalVisits":         totalVisitsAggregate,
 				"uniqueVisitors":      uniqueVisitorsAggregate,
 				"medianVisitDuration": medianVisitDurationAggregateFormatted,
+				"sessions":            sessionsAggregate,
+				"bounceRate":          bounceRateAggregate,
+				"viewsPerSession":     viewsPerSessionAggregate,
+				"sessionDuration":     sessionDurationAggregateFormatted,
 			},
 		})
 		if err != nil {
@@ -484,7 +618,7 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Initialize queries and parameters
-		baseQuery := "SELECT pathname, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		baseQuery := "SELECT pathname, COUNT(*), AVG(scroll_depth) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
 		countQuery := "SELECT COUNT(DISTINCT pathname) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
 		params := []interface{}{domain, start, end}
 		paramIndex := 4
@@ -492,14 +626,19 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -526,6 +665,7 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 		var totalCount int
 		var paths []string
 		var counts []int
+		var scrollDepths []*float64 // average scroll depth, nil for pages without scroll data
 		var countErr, dataErr error
 
 		// Goroutine for count query
@@ -552,12 +692,14 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 			for rows.Next() {
 				var path string
 				var count int
-				if err := rows.Scan(&path, &count); err != nil {
+				var scrollDepth sql.NullFloat64
+				if err := rows.Scan(&path, &count, &scrollDepth); err != nil {
 					dataErr = err
 					return
 				}
 				paths = append(paths, path)
 				counts = append(counts, count)
+				scrollDepths = append(scrollDepths, roundedAverage(scrollDepth))
 			}
 
 			if err := rows.Err(); err != nil {
@@ -582,9 +724,10 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 
 		// Prepare and send the JSON response
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"paths":      paths,
-			"counts":     counts,
-			"totalCount": totalCount,
+			"paths":        paths,
+			"counts":       counts,
+			"scrollDepths": scrollDepths,
+			"totalCount":   totalCount,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -598,9 +741,10 @@ func GetPages(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetReferrers(db *sql.DB) http.HandlerFunc {
+// GetSessionPages breaks sessions down by their entry or exit page (page_column is entry_page or exit_page), with the bounce rate of each page
+func GetSessionPages(db *sql.DB, page_column string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract the domain from the url
+		// Extract the domain from the URL
 		domain, err := utils.ExtractDomainFromURL(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -611,7 +755,7 @@ func GetReferrers(db *sql.DB) http.HandlerFunc {
 		startDate := r.URL.Query().Get("startDate")
 		endDate := r.URL.Query().Get("endDate")
 
-		// Convert the dates to a format suitable for my database
+		// Convert the dates to a format suitable for the database
 		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -633,23 +777,28 @@ func GetReferrers(db *sql.DB) http.HandlerFunc {
 			offset = 0 // default offset
 		}
 
-		// Initialize query and parameters
-		baseQuery := "SELECT referrer, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
-		countQuery := "SELECT COUNT(DISTINCT referrer) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		// Initialize queries and parameters
+		baseQuery := fmt.Sprintf("SELECT %s, COUNT(*), COUNT(*) FILTER (WHERE pageviews = 1) FROM sessions WHERE website_domain = $1 AND started_at BETWEEN $2 AND $3", page_column)
+		countQuery := fmt.Sprintf("SELECT COUNT(DISTINCT %s) FROM sessions WHERE website_domain = $1 AND started_at BETWEEN $2 AND $3", page_column)
 		params := []interface{}{domain, start, end}
-		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+		paramIndex := 4
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -657,25 +806,31 @@ func GetReferrers(db *sql.DB) http.HandlerFunc {
 			"utm_content":  "utm_content",
 		}
 
-		// Add filters to the query
+		// A session matches the filters if one of its visits does
+		visitConditions := ""
 		for param, column := range filters {
 			value := r.URL.Query().Get(param)
 			if value != "" {
-				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
-				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
-				params = append(params, value) // Add the filter value to the parameters list
-				paramIndex++                   // Increment the parameter index for the next filter
+				visitConditions += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
 			}
 		}
+		if visitConditions != "" {
+			sessionCondition := " AND id IN (SELECT session_id FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3" + visitConditions + ")"
+			baseQuery += sessionCondition
+			countQuery += sessionCondition
+		}
 
-		// Complete the queryies
-		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY referrer ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		// Complete the queries
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY %s ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", page_column, paramIndex, paramIndex+1)
 		dataParams := append(params, limit, offset)
 
 		var wg sync.WaitGroup
 		var totalCount int
-		var referrers []string
+		var paths []string
 		var counts []int
+		var bounceRates []float64
 		var countErr, dataErr error
 
 		// Goroutine for count query
@@ -700,14 +855,15 @@ func GetReferrers(db *sql.DB) http.HandlerFunc {
 			defer rows.Close()
 
 			for rows.Next() {
-				var referrer string
-				var count int
-				if err := rows.Scan(&referrer, &count); err != nil {
+				var path string
+				var count, bounces int
+				if err := rows.Scan(&path, &count, &bounces); err != nil {
 					dataErr = err
 					return
 				}
-				referrers = append(referrers, referrer)
+				paths = append(paths, path)
 				counts = append(counts, count)
+				bounceRates = append(bounceRates, percentage(bounces, count))
 			}
 
 			if err := rows.Err(); err != nil {
@@ -725,16 +881,17 @@ func GetReferrers(db *sql.DB) http.HandlerFunc {
 			return
 		}
 		if dataErr != nil {
-			log.Println("Error getting referrer data:", dataErr)
+			log.Println("Error getting session page data:", dataErr)
 			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Prepare and send the JSON response
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"referrers":  referrers,
-			"counts":     counts,
-			"totalCount": totalCount,
+			"paths":       paths,
+			"counts":      counts,
+			"bounceRates": bounceRates,
+			"totalCount":  totalCount,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -748,9 +905,10 @@ func GetReferrers(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetDeviceTypes(db *sql.DB) http.HandlerFunc {
+// GetScrollDepth reports, for every pathname, the average maximum scroll depth of its pageviews and how they are distributed in 25% buckets (0-24, 25-49, 50-74 and 75-100)
+func GetScrollDepth(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract the domain from the url
+		// Extract the domain from the URL
 		domain, err := utils.ExtractDomainFromURL(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -761,7 +919,7 @@ func GetDeviceTypes(db *sql.DB) http.HandlerFunc {
 		startDate := r.URL.Query().Get("startDate")
 		endDate := r.URL.Query().Get("endDate")
 
-		// Convert the dates to a format suitable for my database
+		// Convert the dates to a format suitable for the database
 		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -773,22 +931,45 @@ func GetDeviceTypes(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Initialize query and parameters
-		baseQuery := "SELECT device_type, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize queries and parameters
+		baseQuery := `
+			SELECT pathname, COUNT(*), AVG(scroll_depth),
+				COUNT(*) FILTER (WHERE scroll_depth < 25),
+				COUNT(*) FILTER (WHERE scroll_depth >= 25 AND scroll_depth < 50),
+				COUNT(*) FILTER (WHERE scroll_depth >= 50 AND scroll_depth < 75),
+				COUNT(*) FILTER (WHERE scroll_depth >= 75)
+			FROM visits
+			WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND scroll_depth IS NOT NULL`
+		countQuery := "SELECT COUNT(DISTINCT pathname) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND scroll_depth IS NOT NULL"
 		params := []interface{}{domain, start, end}
-		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+		paramIndex := 4
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -801,41 +982,87 @@ func GetDeviceTypes(db *sql.DB) http.HandlerFunc {
 			value := r.URL.Query().Get(param)
 			if value != "" {
 				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
 				params = append(params, value)
 				paramIndex++
 			}
 		}
 
-		// Complete the query
-		baseQuery += " GROUP BY device_type ORDER BY COUNT(*) DESC"
+		// Complete the queries
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY pathname ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataParams := append(params, limit, offset)
 
-		// Query the database for statistics
-		stats, err := db.Query(baseQuery, params...)
-		if err != nil {
-			log.Println("Error getting website statistics:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		var wg sync.WaitGroup
+		var totalCount int
+		var paths []string
+		var samples []int
+		var averageDepths []*float64
+		var buckets [][4]int
+		var countErr, dataErr error
 
-		// Convert the statistics to JSON
-		defer stats.Close() // Close the result set after we're done with it
-		var deviceType string
-		var count int
-		var deviceTypes []string
-		var counts []int
-		for stats.Next() {
-			err = stats.Scan(&deviceType, &count)
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
 			if err != nil {
-				log.Println("Error scanning statistics:", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
 				return
 			}
-			deviceTypes = append(deviceTypes, deviceType)
-			counts = append(counts, count)
+			defer rows.Close()
+
+			for rows.Next() {
+				var path string
+				var count int
+				var averageDepth sql.NullFloat64
+				var bucket [4]int
+				if err := rows.Scan(&path, &count, &averageDepth, &bucket[0], &bucket[1], &bucket[2], &bucket[3]); err != nil {
+					dataErr = err
+					return
+				}
+				paths = append(paths, path)
+				samples = append(samples, count)
+				averageDepths = append(averageDepths, roundedAverage(averageDepth))
+				buckets = append(buckets, bucket)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting scroll depth data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
 		}
+
+		// Prepare and send the JSON response
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"deviceTypes": deviceTypes,
-			"counts":      counts,
+			"paths":         paths,
+			"samples":       samples,
+			"averageDepths": averageDepths,
+			"buckets":       buckets, // pageviews in the 0-24, 25-49, 50-74 and 75-100 buckets
+			"totalCount":    totalCount,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -849,7 +1076,7 @@ func GetDeviceTypes(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetOSes(db *sql.DB) http.HandlerFunc {
+func GetReferrers(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -874,22 +1101,51 @@ func GetOSes(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Referrers are listed as raw urls by default, groupBy=source groups them by friendly source name (Google, Facebook, ...). Drill down into a source with the source filter.
+		groupColumn := "referrer"
+		responseKey := "referrers"
+		switch r.URL.Query().Get("groupBy") {
+		case "", "referrer":
+		case "source":
+			groupColumn = "referrer_source"
+			responseKey = "sources"
+		default:
+			http.Error(w, "Invalid groupBy", http.StatusBadRequest)
+			return
+		}
+
 		// Initialize query and parameters
-		baseQuery := "SELECT os, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		baseQuery := fmt.Sprintf("SELECT %s, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND %s IS NOT NULL", groupColumn, groupColumn)
+		countQuery := fmt.Sprintf("SELECT COUNT(DISTINCT %s) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3", groupColumn)
 		params := []interface{}{domain, start, end}
 		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -902,41 +1158,185 @@ func GetOSes(db *sql.DB) http.HandlerFunc {
 			value := r.URL.Query().Get(param)
 			if value != "" {
 				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
-				params = append(params, value)
-				paramIndex++
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value) // Add the filter value to the parameters list
+				paramIndex++                   // Increment the parameter index for the next filter
 			}
 		}
 
-		// Complete the query
-		baseQuery += " GROUP BY os ORDER BY COUNT(*) DESC"
-
-		// Query the database for statistics
-		stats, err := db.Query(baseQuery, params...)
-		if err != nil {
-			log.Println("Error getting website statistics:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		// Complete the queryies
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY %s ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", groupColumn, paramIndex, paramIndex+1)
+		dataParams := append(params, limit, offset)
 
-		// Convert the statistics to JSON
-		defer stats.Close() // Close the result set after we're done with it
-		var os string
-		var count int
-		var oses []string
+		var wg sync.WaitGroup
+		var totalCount int
+		var referrers []string
 		var counts []int
-		for stats.Next() {
-			err = stats.Scan(&os, &count)
-			if err != nil {
-				log.Println("Error scanning statistics:", err)
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var referrer string
+				var count int
+				if err := rows.Scan(&referrer, &count); err != nil {
+					dataErr = err
+					return
+				}
+				referrers = append(referrers, referrer)
+				counts = append(counts, count)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting referrer data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			responseKey:  referrers,
+			"counts":     counts,
+			"totalCount": totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func GetDeviceTypes(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT device_type, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		baseQuery += " GROUP BY device_type ORDER BY COUNT(*) DESC"
+
+		// Query the database for statistics
+		stats, err := db.Query(baseQuery, params...)
+		if err != nil {
+			log.Println("Error getting website statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Convert the statistics to JSON
+		defer stats.Close() // Close the result set after we're done with it
+		var deviceType string
+		var count int
+		var deviceTypes []string
+		var counts []int
+		for stats.Next() {
+			err = stats.Scan(&deviceType, &count)
+			if err != nil {
+				log.Println("Error scanning statistics:", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			oses = append(oses, os)
+			deviceTypes = append(deviceTypes, deviceType)
 			counts = append(counts, count)
 		}
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"oses":   oses,
-			"counts": counts,
+			"deviceTypes": deviceTypes,
+			"counts":      counts,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -950,7 +1350,8 @@ func GetOSes(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetBrowsers(db *sql.DB) http.HandlerFunc {
+// GetScreenSizes breaks the visits down by the screen width bucket sent by the tracker (see utils.ScreenSize)
+func GetScreenSizes(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -976,21 +1377,26 @@ func GetBrowsers(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Initialize query and parameters
-		baseQuery := "SELECT browser, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		baseQuery := "SELECT COALESCE(screen_size, ''), COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
 		params := []interface{}{domain, start, end}
 		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -1009,7 +1415,7 @@ func GetBrowsers(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Complete the query
-		baseQuery += " GROUP BY browser ORDER BY COUNT(*) DESC"
+		baseQuery += " GROUP BY COALESCE(screen_size, '') ORDER BY COUNT(*) DESC"
 
 		// Query the database for statistics
 		stats, err := db.Query(baseQuery, params...)
@@ -1021,23 +1427,23 @@ func GetBrowsers(db *sql.DB) http.HandlerFunc {
 
 		// Convert the statistics to JSON
 		defer stats.Close() // Close the result set after we're done with it
-		var browser string
+		var screenSize string
 		var count int
-		var browsers []string
+		var screenSizes []string
 		var counts []int
 		for stats.Next() {
-			err = stats.Scan(&browser, &count)
+			err = stats.Scan(&screenSize, &count)
 			if err != nil {
 				log.Println("Error scanning statistics:", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			browsers = append(browsers, browser)
+			screenSizes = append(screenSizes, screenSize)
 			counts = append(counts, count)
 		}
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"browsers": browsers,
-			"counts":   counts,
+			"screenSizes": screenSizes, // width buckets, empty for visits sent without the screen width
+			"counts":      counts,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -1051,7 +1457,7 @@ func GetBrowsers(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetLanguages(db *sql.DB) http.HandlerFunc {
+func GetOSes(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -1076,33 +1482,34 @@ func GetLanguages(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Extract limit and offset from query string
-		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
-		if err != nil || limit <= 0 {
-			limit = 10 // default limit
-		}
-		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
-		if err != nil || offset < 0 {
-			offset = 0 // default offset
+		// Filtering by os drills down into its versions, visits stored before the versions were collected have an empty one
+		drillDown := r.URL.Query().Get("os") != ""
+		versionColumn := "''"
+		if drillDown {
+			versionColumn = "COALESCE(os_version, '')"
 		}
 
 		// Initialize query and parameters
-		baseQuery := "SELECT language, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
-		countQuery := "SELECT COUNT(DISTINCT language) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		baseQuery := "SELECT os, " + versionColumn + ", COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
 		params := []interface{}{domain, start, end}
 		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -1115,19 +1522,1083 @@ func GetLanguages(db *sql.DB) http.HandlerFunc {
 			value := r.URL.Query().Get(param)
 			if value != "" {
 				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
-				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
 				params = append(params, value)
 				paramIndex++
 			}
 		}
 
 		// Complete the query
-		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY language ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
-		dataParams := append(params, limit, offset)
+		if drillDown {
+			baseQuery += " GROUP BY os, " + versionColumn + " ORDER BY COUNT(*) DESC"
+		} else {
+			baseQuery += " GROUP BY os ORDER BY COUNT(*) DESC" // Postgres doesn't group by the '' placeholder
+		}
+
+		// Query the database for statistics
+		stats, err := db.Query(baseQuery, params...)
+		if err != nil {
+			log.Println("Error getting website statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Convert the statistics to JSON
+		defer stats.Close() // Close the result set after we're done with it
+		var os string
+		var version string
+		var count int
+		var oses []string
+		var versions []string
+		var counts []int
+		for stats.Next() {
+			err = stats.Scan(&os, &version, &count)
+			if err != nil {
+				log.Println("Error scanning statistics:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			oses = append(oses, os)
+			versions = append(versions, version)
+			counts = append(counts, count)
+		}
+		response := map[string]interface{}{
+			"oses":   oses,
+			"counts": counts,
+		}
+		if drillDown {
+			response["versions"] = versions // in the same order as oses
+		}
+		jsonStats, err := json.Marshal(response)
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func GetBrowsers(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Filtering by browser drills down into its versions, visits stored before the versions were collected have an empty one
+		drillDown := r.URL.Query().Get("browser") != ""
+		versionColumn := "''"
+		if drillDown {
+			versionColumn = "COALESCE(browser_version, '')"
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT browser, " + versionColumn + ", COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		if drillDown {
+			baseQuery += " GROUP BY browser, " + versionColumn + " ORDER BY COUNT(*) DESC"
+		} else {
+			baseQuery += " GROUP BY browser ORDER BY COUNT(*) DESC" // Postgres doesn't group by the '' placeholder
+		}
+
+		// Query the database for statistics
+		stats, err := db.Query(baseQuery, params...)
+		if err != nil {
+			log.Println("Error getting website statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Convert the statistics to JSON
+		defer stats.Close() // Close the result set after we're done with it
+		var browser string
+		var version string
+		var count int
+		var browsers []string
+		var versions []string
+		var counts []int
+		for stats.Next() {
+			err = stats.Scan(&browser, &version, &count)
+			if err != nil {
+				log.Println("Error scanning statistics:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			browsers = append(browsers, browser)
+			versions = append(versions, version)
+			counts = append(counts, count)
+		}
+		response := map[string]interface{}{
+			"browsers": browsers,
+			"counts":   counts,
+		}
+		if drillDown {
+			response["versions"] = versions // in the same order as browsers
+		}
+		jsonStats, err := json.Marshal(response)
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func GetLanguages(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT language, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		countQuery := "SELECT COUNT(DISTINCT language) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY language ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataParams := append(params, limit, offset)
+
+		var wg sync.WaitGroup
+		var totalCount int
+		var languages []string
+		var counts []int
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var language string
+				var count int
+				if err := rows.Scan(&language, &count); err != nil {
+					dataErr = err
+					return
+				}
+				languages = append(languages, language)
+				counts = append(counts, count)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting language data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"languages":  languages,
+			"counts":     counts,
+			"totalCount": totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+// GetHostnames breaks down the visits of a website by the hostname they were sent from (the registered domain, its www. counterpart or one of its aliases)
+func GetHostnames(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT hostname, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND hostname IS NOT NULL"
+		countQuery := "SELECT COUNT(DISTINCT hostname) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND hostname IS NOT NULL"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY hostname ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataParams := append(params, limit, offset)
+
+		var wg sync.WaitGroup
+		var totalCount int
+		var hostnames []string
+		var counts []int
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var hostname string
+				var count int
+				if err := rows.Scan(&hostname, &count); err != nil {
+					dataErr = err
+					return
+				}
+				hostnames = append(hostnames, hostname)
+				counts = append(counts, count)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting hostname data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"hostnames":  hostnames,
+			"counts":     counts,
+			"totalCount": totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+// GetChannels breaks down the visits of a website by traffic channel (Direct, Organic Search, Social, ...)
+func GetChannels(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT channel, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND channel IS NOT NULL"
+		countQuery := "SELECT COUNT(DISTINCT channel) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND channel IS NOT NULL"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY channel ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataParams := append(params, limit, offset)
+
+		var wg sync.WaitGroup
+		var totalCount int
+		var channels []string
+		var counts []int
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var channel string
+				var count int
+				if err := rows.Scan(&channel, &count); err != nil {
+					dataErr = err
+					return
+				}
+				channels = append(channels, channel)
+				counts = append(counts, count)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting channel data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"channels":   channels,
+			"counts":     counts,
+			"totalCount": totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func GetCountries(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		// Visits stored before the country codes were collected have no code, MAX picks the code of the newer ones
+		baseQuery := "SELECT country, COALESCE(MAX(country_code), '') AS country_code, MAX(country_geoname_id) AS geoname_id, COUNT(*) AS count FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		countQuery := "SELECT COUNT(DISTINCT country) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		// Countries are grouped by their English name, which filters use, and the name in the requested locale is looked up for the page only
+		locale, localeFallback := utils.RequestLocale(r)
+		dataQuery := "SELECT breakdown.country, breakdown.country_code, COALESCE(geo_names.name, breakdown.country), breakdown.count FROM (" +
+			baseQuery + fmt.Sprintf(" GROUP BY country ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1) +
+			fmt.Sprintf(") AS breakdown LEFT JOIN geo_names ON geo_names.geoname_id = breakdown.geoname_id AND geo_names.locale = $%d ORDER BY breakdown.count DESC", paramIndex+2)
+		dataParams := append(params, limit, offset, locale)
+
+		var wg sync.WaitGroup
+		var totalCount int
+		var countries []string
+		var countryCodes []string
+		var countryNames []string
+		var counts []int
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var country string
+				var countryCode string
+				var countryName string
+				var count int
+				if err := rows.Scan(&country, &countryCode, &countryName, &count); err != nil {
+					dataErr = err
+					return
+				}
+				countries = append(countries, country)
+				countryCodes = append(countryCodes, countryCode)
+				countryNames = append(countryNames, countryName)
+				counts = append(counts, count)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting country data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"countries":      countries,    // English names, the values the country filter takes
+			"countryCodes":   countryCodes, // ISO 3166-1 alpha-2, empty for unknown countries
+			"countryNames":   countryNames, // names in the requested locale, English if there is no translation
+			"locale":         locale,
+			"localeFallback": localeFallback, // the preferred language of the user has no geographic names (e.g. Italian), they are in locale instead
+			"counts":         counts,
+			"totalCount":     totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func GetRegions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT MAX(region) AS region, MAX(region_geoname_id) AS geoname_id, COUNT(*) AS count FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		countQuery := "SELECT COUNT(DISTINCT COALESCE(region_geoname_id::text, region)) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		// Grouped by GeoNames ID so that places sharing an English name (e.g. Springfield) stay apart, by English name for the visits without one. The name in the requested locale is looked up for the page only.
+		locale, localeFallback := utils.RequestLocale(r)
+		dataQuery := "SELECT breakdown.region, COALESCE(breakdown.geoname_id, 0), COALESCE(geo_names.name, breakdown.region), breakdown.count FROM (" +
+			baseQuery + fmt.Sprintf(" GROUP BY COALESCE(region_geoname_id::text, region) ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1) +
+			fmt.Sprintf(") AS breakdown LEFT JOIN geo_names ON geo_names.geoname_id = breakdown.geoname_id AND geo_names.locale = $%d ORDER BY breakdown.count DESC", paramIndex+2)
+		dataParams := append(params, limit, offset, locale)
+
+		var wg sync.WaitGroup
+		var totalCount int
+		var regions []string
+		var regionIDs []int
+		var regionNames []string
+		var counts []int
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := db.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var region string
+				var regionID int
+				var regionName string
+				var count int
+				if err := rows.Scan(&region, &regionID, &regionName, &count); err != nil {
+					dataErr = err
+					return
+				}
+				regions = append(regions, region)
+				regionIDs = append(regionIDs, regionID)
+				regionNames = append(regionNames, regionName)
+				counts = append(counts, count)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting region data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"regions":        regions,     // English names, the values the region filter takes
+			"regionIds":      regionIDs,   // GeoNames IDs, the values the region_id filter takes to tell apart places sharing a name, 0 if unknown
+			"regionNames":    regionNames, // names in the requested locale, English if there is no translation
+			"locale":         locale,
+			"localeFallback": localeFallback, // the preferred language of the user has no geographic names (e.g. Italian), they are in locale instead
+			"counts":         counts,
+			"totalCount":     totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func GetCities(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT MAX(city) AS city, MAX(city_geoname_id) AS geoname_id, COUNT(*) AS count FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		countQuery := "SELECT COUNT(DISTINCT COALESCE(city_geoname_id::text, city)) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		params := []interface{}{domain, start, end}
+		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// Complete the query
+		// Grouped by GeoNames ID so that places sharing an English name (e.g. Springfield) stay apart, by English name for the visits without one. The name in the requested locale is looked up for the page only.
+		locale, localeFallback := utils.RequestLocale(r)
+		dataQuery := "SELECT breakdown.city, COALESCE(breakdown.geoname_id, 0), COALESCE(geo_names.name, breakdown.city), breakdown.count FROM (" +
+			baseQuery + fmt.Sprintf(" GROUP BY COALESCE(city_geoname_id::text, city) ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1) +
+			fmt.Sprintf(") AS breakdown LEFT JOIN geo_names ON geo_names.geoname_id = breakdown.geoname_id AND geo_names.locale = $%d ORDER BY breakdown.count DESC", paramIndex+2)
+		dataParams := append(params, limit, offset, locale)
 
 		var wg sync.WaitGroup
 		var totalCount int
-		var languages []string
+		var cities []string
+		var cityIDs []int
+		var cityNames []string
 		var counts []int
 		var countErr, dataErr error
 
@@ -1153,13 +2624,17 @@ func GetLanguages(db *sql.DB) http.HandlerFunc {
 			defer rows.Close()
 
 			for rows.Next() {
-				var language string
+				var city string
+				var cityID int
+				var cityName string
 				var count int
-				if err := rows.Scan(&language, &count); err != nil {
+				if err := rows.Scan(&city, &cityID, &cityName, &count); err != nil {
 					dataErr = err
 					return
 				}
-				languages = append(languages, language)
+				cities = append(cities, city)
+				cityIDs = append(cityIDs, cityID)
+				cityNames = append(cityNames, cityName)
 				counts = append(counts, count)
 			}
 
@@ -1178,16 +2653,20 @@ func GetLanguages(db *sql.DB) http.HandlerFunc {
 			return
 		}
 		if dataErr != nil {
-			log.Println("Error getting language data:", dataErr)
+			log.Println("Error getting city data:", dataErr)
 			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Prepare and send the JSON response
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"languages":  languages,
-			"counts":     counts,
-			"totalCount": totalCount,
+			"cities":         cities,    // English names, the values the city filter takes
+			"cityIds":        cityIDs,   // GeoNames IDs, the values the city_id filter takes to tell apart places sharing a name, 0 if unknown
+			"cityNames":      cityNames, // names in the requested locale, English if there is no translation
+			"locale":         locale,
+			"localeFallback": localeFallback, // the preferred language of the user has no geographic names (e.g. Italian), they are in locale instead
+			"counts":         counts,
+			"totalCount":     totalCount,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -1201,7 +2680,8 @@ func GetLanguages(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetCountries(db *sql.DB) http.HandlerFunc {
+// GetASNs breaks the visits down by the autonomous system of the visitor, flagging the cloud, hosting and datacenter networks. Visits stored without an ASN database are grouped under ASN 0. It's only routed for admins.
+func GetASNs(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -1237,22 +2717,28 @@ func GetCountries(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Initialize query and parameters
-		baseQuery := "SELECT country, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
-		countQuery := "SELECT COUNT(DISTINCT country) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		// The organization name of an ASN can change between database releases, MAX picks one of them
+		baseQuery := "SELECT COALESCE(asn, 0), COALESCE(MAX(asn_organization), ''), BOOL_OR(is_datacenter), COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		countQuery := "SELECT COUNT(DISTINCT COALESCE(asn, 0)), COUNT(*) FILTER (WHERE is_datacenter) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
 		params := []interface{}{domain, start, end}
 		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
-			"city":         "city",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -1272,12 +2758,15 @@ func GetCountries(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Complete the query
-		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY country ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY COALESCE(asn, 0) ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
 		dataParams := append(params, limit, offset)
 
 		var wg sync.WaitGroup
 		var totalCount int
-		var countries []string
+		var datacenterCount int
+		var asns []int
+		var organizations []string
+		var datacenters []bool
 		var counts []int
 		var countErr, dataErr error
 
@@ -1285,7 +2774,7 @@ func GetCountries(db *sql.DB) http.HandlerFunc {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
+			err := db.QueryRow(countQuery, params...).Scan(&totalCount, &datacenterCount)
 			if err != nil {
 				countErr = err
 			}
@@ -1303,13 +2792,17 @@ func GetCountries(db *sql.DB) http.HandlerFunc {
 			defer rows.Close()
 
 			for rows.Next() {
-				var country string
+				var asn int
+				var organization string
+				var datacenter bool
 				var count int
-				if err := rows.Scan(&country, &count); err != nil {
+				if err := rows.Scan(&asn, &organization, &datacenter, &count); err != nil {
 					dataErr = err
 					return
 				}
-				countries = append(countries, country)
+				asns = append(asns, asn)
+				organizations = append(organizations, organization)
+				datacenters = append(datacenters, datacenter)
 				counts = append(counts, count)
 			}
 
@@ -1328,16 +2821,19 @@ func GetCountries(db *sql.DB) http.HandlerFunc {
 			return
 		}
 		if dataErr != nil {
-			log.Println("Error getting country data:", dataErr)
+			log.Println("Error getting asn data:", dataErr)
 			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Prepare and send the JSON response
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"countries":  countries,
-			"counts":     counts,
-			"totalCount": totalCount,
+			"asns":            asns,
+			"organizations":   organizations,
+			"datacenters":     datacenters, // the ASN belongs to a cloud, hosting or datacenter provider
+			"counts":          counts,
+			"totalCount":      totalCount,
+			"datacenterCount": datacenterCount, // visits flagged as datacenter traffic in the period
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -1351,7 +2847,7 @@ func GetCountries(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetRegions(db *sql.DB) http.HandlerFunc {
+func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -1386,23 +2882,28 @@ func GetRegions(db *sql.DB) http.HandlerFunc {
 			offset = 0 // default offset
 		}
 
-		// Initialize query and parameters
-		baseQuery := "SELECT region, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
-		countQuery := "SELECT COUNT(DISTINCT region) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		// Dynamic query construction using the utm_parameter
+		baseQuery := fmt.Sprintf("SELECT %s, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND %s IS NOT NULL AND %s != ''", utm_parameter, utm_parameter, utm_parameter)
+		countQuery := fmt.Sprintf("SELECT COUNT(DISTINCT %s) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND %s IS NOT NULL AND %s != ''", utm_parameter, utm_parameter, utm_parameter)
 		params := []interface{}{domain, start, end}
 		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
-			"region":       "region",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -1422,12 +2923,12 @@ func GetRegions(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Complete the query
-		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY region ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY %s ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", utm_parameter, paramIndex, paramIndex+1)
 		dataParams := append(params, limit, offset)
 
 		var wg sync.WaitGroup
 		var totalCount int
-		var regions []string
+		var utm_values []string
 		var counts []int
 		var countErr, dataErr error
 
@@ -1453,13 +2954,13 @@ func GetRegions(db *sql.DB) http.HandlerFunc {
 			defer rows.Close()
 
 			for rows.Next() {
-				var region string
+				var utm_value string
 				var count int
-				if err := rows.Scan(&region, &count); err != nil {
+				if err := rows.Scan(&utm_value, &count); err != nil {
 					dataErr = err
 					return
 				}
-				regions = append(regions, region)
+				utm_values = append(utm_values, utm_value)
 				counts = append(counts, count)
 			}
 
@@ -1478,14 +2979,14 @@ func GetRegions(db *sql.DB) http.HandlerFunc {
 			return
 		}
 		if dataErr != nil {
-			log.Println("Error getting region data:", dataErr)
+			log.Println("Error getting utm parameters data:", dataErr)
 			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Prepare and send the JSON response
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"regions":    regions,
+			"utm_values": utm_values,
 			"counts":     counts,
 			"totalCount": totalCount,
 		})
@@ -1501,7 +3002,51 @@ func GetRegions(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetCities(db *sql.DB) http.HandlerFunc {
+// Web vitals columns of the visits table
+var webVitals = []string{"lcp", "cls", "inp", "fcp", "ttfb"}
+
+// webVitalsPercentiles returns the select expressions computing the p50, p75 and p95 of every web vital, plus the number of samples
+func webVitalsPercentiles() string {
+	expressions := make([]string, 0, len(webVitals)*2)
+	for _, vital := range webVitals {
+		expressions = append(expressions, fmt.Sprintf("PERCENTILE_CONT(ARRAY[0.5, 0.75, 0.95]) WITHIN GROUP (ORDER BY %s)", vital), fmt.Sprintf("COUNT(%s)", vital))
+	}
+	return strings.Join(expressions, ", ")
+}
+
+// scanWebVitals scans the columns selected by webVitalsPercentiles, after the leading columns in dest
+func scanWebVitals(rows *sql.Rows, dest ...interface{}) (map[string]interface{}, error) {
+	percentiles := make([][]float64, len(webVitals))
+	samples := make([]int, len(webVitals))
+	for i := range webVitals {
+		dest = append(dest, pq.Array(&percentiles[i]), &samples[i])
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	vitals := make(map[string]interface{}, len(webVitals))
+	for i, vital := range webVitals {
+		vitals[vital] = webVitalStats(percentiles[i], samples[i])
+	}
+	return vitals, nil
+}
+
+// webVitalStats formats the percentiles of a web vital, null if there are no samples
+func webVitalStats(percentiles []float64, samples int) interface{} {
+	if samples == 0 || len(percentiles) != 3 {
+		return nil
+	}
+	return map[string]interface{}{
+		"p50":     math.Round(percentiles[0]*1000) / 1000,
+		"p75":     math.Round(percentiles[1]*1000) / 1000,
+		"p95":     math.Round(percentiles[2]*1000) / 1000,
+		"samples": samples,
+	}
+}
+
+// GetWebVitals returns the p50, p75 and p95 of the Core Web Vitals reported by the tracker for every period in the range
+func GetWebVitals(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -1526,33 +3071,57 @@ func GetCities(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Extract limit and offset from query string
-		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
-		if err != nil || limit <= 0 {
-			limit = 10 // default limit
+		// Extract the interval from the request query parameters
+		interval := r.URL.Query().Get("interval")
+		if interval != "hour" && interval != "day" && interval != "month" {
+			http.Error(w, "Invalid interval", http.StatusBadRequest)
+			return
 		}
-		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
-		if err != nil || offset < 0 {
-			offset = 0 // default offset
+
+		// Generate a list of all periods in the range
+		periods := make([]time.Time, 0)
+		for d := start; !d.After(end); {
+			switch interval {
+			case "hour":
+				d = d.Truncate(time.Hour)
+				periods = append(periods, d)
+				d = d.Add(time.Hour)
+			case "month":
+				d = time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+				periods = append(periods, d)
+				d = d.AddDate(0, 1, 0)
+			case "day":
+				d = d.Truncate(24 * time.Hour)
+				periods = append(periods, d)
+				d = d.AddDate(0, 0, 1)
+			}
 		}
 
-		// Initialize query and parameters
-		baseQuery := "SELECT city, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
-		countQuery := "SELECT COUNT(DISTINCT city) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"
+		// Initialize base query and parameters for filtering
+		baseQuery := fmt.Sprintf(`
+			SELECT DATE_TRUNC('%s', timestamp) AS period, %s
+			FROM visits
+			WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3
+				AND (lcp IS NOT NULL OR cls IS NOT NULL OR inp IS NOT NULL OR fcp IS NOT NULL OR ttfb IS NOT NULL)`, interval, webVitalsPercentiles())
 		params := []interface{}{domain, start, end}
-		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+		paramIndex := 4
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
-			"region":       "region",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -1565,79 +3134,65 @@ func GetCities(db *sql.DB) http.HandlerFunc {
 			value := r.URL.Query().Get(param)
 			if value != "" {
 				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
-				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
 				params = append(params, value)
 				paramIndex++
 			}
 		}
 
-		// Complete the query
-		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY city ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
-		dataParams := append(params, limit, offset)
-
-		var wg sync.WaitGroup
-		var totalCount int
-		var cities []string
-		var counts []int
-		var countErr, dataErr error
+		// Complete the query with grouping and ordering
+		baseQuery += " GROUP BY period ORDER BY period ASC"
 
-		// Goroutine for count query
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err := db.QueryRow(countQuery, params...).Scan(&totalCount)
-			if err != nil {
-				countErr = err
-			}
-		}()
+		rows, err := db.Query(baseQuery, params...)
+		if err != nil {
+			log.Println("Error getting web vitals:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
 
-		// Goroutine for data query
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			rows, err := db.Query(dataQuery, dataParams...)
+		var dataPoints []map[string]interface{}
+		for rows.Next() {
+			var period time.Time
+			dataPoint, err := scanWebVitals(rows, &period)
 			if err != nil {
-				dataErr = err
+				log.Println("Error scanning web vitals:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			defer rows.Close()
+			dataPoint["period"] = period.Format(time.RFC3339)
+			dataPoints = append(dataPoints, dataPoint)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating web vitals:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			for rows.Next() {
-				var city string
-				var count int
-				if err := rows.Scan(&city, &count); err != nil {
-					dataErr = err
-					return
+		// Fill in missing periods with empty values
+		for _, p := range periods {
+			found := false
+			for _, dp := range dataPoints {
+				if dp["period"] == p.Format(time.RFC3339) {
+					found = true
+					break
 				}
-				cities = append(cities, city)
-				counts = append(counts, count)
 			}
-
-			if err := rows.Err(); err != nil {
-				dataErr = err
+			if !found {
+				dataPoint := map[string]interface{}{"period": p.Format(time.RFC3339)}
+				for _, vital := range webVitals {
+					dataPoint[vital] = nil
+				}
+				dataPoints = append(dataPoints, dataPoint)
 			}
-		}()
-
-		// Wait for both goroutines to finish
-		wg.Wait()
-
-		// Check for errors
-		if countErr != nil {
-			log.Println("Error getting total count:", countErr)
-			http.Error(w, countErr.Error(), http.StatusInternalServerError)
-			return
-		}
-		if dataErr != nil {
-			log.Println("Error getting city data:", dataErr)
-			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
-			return
 		}
 
-		// Prepare and send the JSON response
+		// Sort data points by period
+		sort.Slice(dataPoints, func(i, j int) bool {
+			return dataPoints[i]["period"].(string) < dataPoints[j]["period"].(string)
+		})
+
 		jsonStats, err := json.Marshal(map[string]interface{}{
-			"cities":     cities,
-			"counts":     counts,
-			"totalCount": totalCount,
+			"perIntervalStats": dataPoints,
 		})
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
@@ -1651,7 +3206,8 @@ func GetCities(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
+// GetWebVitalsBreakdown returns the p50, p75 and p95 of the Core Web Vitals grouped by pathname, device_type, browser or country (groupBy query parameter)
+func GetWebVitalsBreakdown(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Extract the domain from the url
 		domain, err := utils.ExtractDomainFromURL(r)
@@ -1660,6 +3216,13 @@ func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
 			return
 		}
 
+		// Only these columns can be grouped by, the value ends up in the query
+		groupBy := r.URL.Query().Get("groupBy")
+		if groupBy != "pathname" && groupBy != "device_type" && groupBy != "browser" && groupBy != "country" {
+			http.Error(w, "groupBy must be one of pathname, device_type, browser or country", http.StatusBadRequest)
+			return
+		}
+
 		// Extract start and end dates from the request query parameters
 		startDate := r.URL.Query().Get("startDate")
 		endDate := r.URL.Query().Get("endDate")
@@ -1686,23 +3249,27 @@ func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
 			offset = 0 // default offset
 		}
 
-		// Dynamic query construction using the utm_parameter
-		baseQuery := fmt.Sprintf("SELECT %s, COUNT(*) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND %s IS NOT NULL AND %s != ''", utm_parameter, utm_parameter, utm_parameter)
-		countQuery := fmt.Sprintf("SELECT COUNT(DISTINCT %s) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND %s IS NOT NULL AND %s != ''", utm_parameter, utm_parameter, utm_parameter)
+		// Initialize queries and parameters
+		conditions := " FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND (lcp IS NOT NULL OR cls IS NOT NULL OR inp IS NOT NULL OR fcp IS NOT NULL OR ttfb IS NOT NULL)"
 		params := []interface{}{domain, start, end}
-		paramIndex := 4 // Start the parameter index at 4 because $1, $2, and $3 are already used
+		paramIndex := 4
 
 		// Map query parameter names to column names
 		filters := map[string]string{
 			"referrer":     "referrer",
+			"source":       "referrer_source",
 			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
 			"device_type":  "device_type",
 			"os":           "os",
 			"browser":      "browser",
 			"language":     "language",
 			"country":      "country",
 			"city":         "city",
+			"city_id":      "city_geoname_id::text",
 			"region":       "region",
+			"region_id":    "region_geoname_id::text",
 			"utm_source":   "utm_source",
 			"utm_medium":   "utm_medium",
 			"utm_campaign": "utm_campaign",
@@ -1714,21 +3281,22 @@ func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
 		for param, column := range filters {
 			value := r.URL.Query().Get(param)
 			if value != "" {
-				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
-				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				conditions += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
 				params = append(params, value)
 				paramIndex++
 			}
 		}
 
-		// Complete the query
-		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY %s ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", utm_parameter, paramIndex, paramIndex+1)
+		// Complete the queries
+		countQuery := fmt.Sprintf("SELECT COUNT(DISTINCT %s)", groupBy) + conditions
+		dataQuery := fmt.Sprintf("SELECT %s, COUNT(*), %s", groupBy, webVitalsPercentiles()) + conditions + fmt.Sprintf(" GROUP BY %s ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", groupBy, paramIndex, paramIndex+1)
 		dataParams := append(params, limit, offset)
 
 		var wg sync.WaitGroup
 		var totalCount int
-		var utm_values []string
-		var counts []int
+		var values []string
+		var pageviews []int
+		vitals := make(map[string][]interface{}, len(webVitals))
 		var countErr, dataErr error
 
 		// Goroutine for count query
@@ -1753,14 +3321,18 @@ func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
 			defer rows.Close()
 
 			for rows.Next() {
-				var utm_value string
+				var value string
 				var count int
-				if err := rows.Scan(&utm_value, &count); err != nil {
+				stats, err := scanWebVitals(rows, &value, &count)
+				if err != nil {
 					dataErr = err
 					return
 				}
-				utm_values = append(utm_values, utm_value)
-				counts = append(counts, count)
+				values = append(values, value)
+				pageviews = append(pageviews, count)
+				for _, vital := range webVitals {
+					vitals[vital] = append(vitals[vital], stats[vital])
+				}
 			}
 
 			if err := rows.Err(); err != nil {
@@ -1778,17 +3350,21 @@ func GetUTMParameters(db *sql.DB, utm_parameter string) http.HandlerFunc {
 			return
 		}
 		if dataErr != nil {
-			log.Println("Error getting utm parameters data:", dataErr)
+			log.Println("Error getting web vitals data:", dataErr)
 			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Prepare and send the JSON response
-		jsonStats, err := json.Marshal(map[string]interface{}{
-			"utm_values": utm_values,
-			"counts":     counts,
+		response := map[string]interface{}{
+			"values":     values,
+			"pageviews":  pageviews, // pageviews with at least one web vital
 			"totalCount": totalCount,
-		})
+		}
+		for _, vital := range webVitals {
+			response[vital] = vitals[vital]
+		}
+		jsonStats, err := json.Marshal(response)
 		if err != nil {
 			log.Println("Error marshalling statistics:", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1828,3 +3404,108 @@ func GetLivePageViews(db *sql.DB) http.HandlerFunc {
 		w.Write(jsonResponse)
 	}
 }
+
+// GetFilteredHits returns how many hits were discarded at ingest for the website, grouped by reason (e.g. bots)
+func GetFilteredHits(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The counters are kept per day
+		query := `
+			SELECT filtered_hits.reason, SUM(filtered_hits.count)
+			FROM filtered_hits
+			JOIN websites ON websites.id = filtered_hits.website_id
+			WHERE websites.domain = $1 AND filtered_hits.date BETWEEN $2::date AND $3::date
+			GROUP BY filtered_hits.reason
+			ORDER BY SUM(filtered_hits.count) DESC
+		`
+
+		rows, err := db.Query(query, domain, start, end)
+		if err != nil {
+			log.Println("Error getting filtered hits:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var reasons []string
+		var counts []int
+		var totalCount int
+		for rows.Next() {
+			var reason string
+			var count int
+			if err := rows.Scan(&reason, &count); err != nil {
+				log.Println("Error scanning filtered hits:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reasons = append(reasons, reason)
+			counts = append(counts, count)
+			totalCount += count
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating filtered hits:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"reasons":    reasons,
+			"counts":     counts,
+			"totalCount": totalCount,
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+// formatSeconds formats a duration in seconds like 1h 2m 3s, 2m 3s or 3s
+func formatSeconds(duration float64) string {
+	hours := int(duration / 3600)
+	minutes := int(math.Mod(duration, 3600) / 60)
+	seconds := int(math.Mod(duration, 60))
+
+	if hours > 0 {
+		return fmt.Sprintf("%dh %dm %ds", hours, minutes, seconds)
+	} else if minutes > 0 {
+		return fmt.Sprintf("%dm %ds", minutes, seconds)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// roundedAverage rounds an AVG() result to one decimal, nil if there was nothing to average
+func roundedAverage(average sql.NullFloat64) *float64 {
+	if !average.Valid {
+		return nil
+	}
+	rounded := math.Round(average.Float64*10) / 10
+	return &rounded
+}
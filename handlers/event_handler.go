@@ -3,17 +3,16 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
-	"net/url"
-	"os"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/mileusna/useragent"
+	"github.com/mvavassori/flockcounter/services"
 	"github.com/mvavassori/flockcounter/utils"
-	"github.com/oschwald/geoip2-golang"
 
 	"github.com/mvavassori/flockcounter/models"
 )
@@ -104,37 +103,171 @@ func GetEvents(postgresDB *sql.DB) http.HandlerFunc {
 
 }
 
-func CreateEvent(postgresDB *sql.DB, geoipDB *geoip2.Reader) http.HandlerFunc {
+// GetEventProperties breaks down the events with the given name by the values of one of their custom properties, with the number of events and of unique visitors for each value. Visitors are identified by the daily hashed identifier, so a visitor coming back on different days is counted once per day.
+func GetEventProperties(postgresDB *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		var parsedIP net.IP
-		if os.Getenv("ENV") == "production" {
-			// Try different headers first, then fall back to RemoteAddr
-			ipAddress := utils.GetIPAddress(r)
-			if ipAddress == "" {
-				log.Println("Could not determine IP address")
-				http.Error(w, "Could not determine IP address", http.StatusInternalServerError)
-				return
+		eventName := r.URL.Query().Get("name")
+		property := r.URL.Query().Get("property")
+		if eventName == "" || property == "" {
+			http.Error(w, "name and property are required", http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract limit and offset from query string
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 10 // default limit
+		}
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0 // default offset
+		}
+
+		// Initialize query and parameters
+		baseQuery := "SELECT properties ->> $4, COUNT(*), COUNT(DISTINCT visitor_id) FROM events WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND properties ->> $4 IS NOT NULL AND name = $5"
+		countQuery := "SELECT COUNT(DISTINCT properties ->> $4) FROM events WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND properties ->> $4 IS NOT NULL AND name = $5"
+		params := []interface{}{domain, start, end, property, eventName}
+		paramIndex := 6 // Start the parameter index at 6 because $1 to $5 are already used
+
+		// Map query parameter names to column names, events don't have the utm columns of visits
+		filters := map[string]string{
+			"referrer":    "referrer",
+			"pathname":    "pathname",
+			"device_type": "device_type",
+			"os":          "os",
+			"browser":     "browser",
+			"language":    "language",
+			"country":     "country",
+			"city":        "city",
+			"city_id":     "city_geoname_id::text",
+			"region":      "region",
+			"region_id":   "region_geoname_id::text",
+		}
+
+		// Add filters to the query
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				baseQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				countQuery += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
 			}
-			parsedIP = net.ParseIP(ipAddress)
-		} else {
-			parsedIP = net.ParseIP("151.30.13.167") // test IP
 		}
 
-		if parsedIP == nil {
-			log.Println("Invalid IP format")
-			http.Error(w, "Invalid IP format", http.StatusBadRequest)
+		// Complete the query
+		dataQuery := baseQuery + fmt.Sprintf(" GROUP BY 1 ORDER BY COUNT(*) DESC LIMIT $%d OFFSET $%d", paramIndex, paramIndex+1)
+		dataParams := append(params, limit, offset)
+
+		var wg sync.WaitGroup
+		var totalCount int
+		var values []string
+		var counts []int
+		var uniqueVisitors []int
+		var countErr, dataErr error
+
+		// Goroutine for count query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := postgresDB.QueryRow(countQuery, params...).Scan(&totalCount)
+			if err != nil {
+				countErr = err
+			}
+		}()
+
+		// Goroutine for data query
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := postgresDB.Query(dataQuery, dataParams...)
+			if err != nil {
+				dataErr = err
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var value string
+				var count, unique int
+				if err := rows.Scan(&value, &count, &unique); err != nil {
+					dataErr = err
+					return
+				}
+				values = append(values, value)
+				counts = append(counts, count)
+				uniqueVisitors = append(uniqueVisitors, unique)
+			}
+
+			if err := rows.Err(); err != nil {
+				dataErr = err
+			}
+		}()
+
+		// Wait for both goroutines to finish
+		wg.Wait()
+
+		// Check for errors
+		if countErr != nil {
+			log.Println("Error getting total count:", countErr)
+			http.Error(w, countErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		if dataErr != nil {
+			log.Println("Error getting event property data:", dataErr)
+			http.Error(w, dataErr.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		record, err := geoipDB.City(parsedIP)
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"values":         values,
+			"counts":         counts,
+			"uniqueVisitors": uniqueVisitors,
+			"totalCount":     totalCount,
+		})
 		if err != nil {
-			log.Printf("Error retrieving location for IP %v: %v", parsedIP, err)
-			http.Error(w, "Error retrieving location", http.StatusInternalServerError)
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		location := utils.GetLocationInfo(record)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func CreateEvent(postgresDB *sql.DB, geolocator utils.Geolocator, ingestQueue *services.IngestQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := authenticateIngestRequest(postgresDB, r)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
+			return
+		}
 
 		// create a EventReceiver struct to hold the request data
 		var eventReceiver models.EventReceiver
@@ -144,136 +277,153 @@ func CreateEvent(postgresDB *sql.DB, geoipDB *geoip2.Reader) http.HandlerFunc {
 			return
 		}
 
-		ua := useragent.Parse(eventReceiver.UserAgent)
-
-		url, err := url.Parse(eventReceiver.URL)
+		parsedIP, err := caller.visitorIP(eventReceiver.IP)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
 			return
 		}
+		eventReceiver.Timestamp = caller.timestamp(eventReceiver.Timestamp)
 
-		domain := url.Hostname()
+		pending, err := services.BuildEvent(geolocator, parsedIP, caller.locationHeader, caller.clientHints, eventReceiver, caller.serverSide())
+		if err != nil {
+			log.Println("Error building event:", err)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
+			return
+		}
 
-		// extract the referrer
-		referrer := eventReceiver.Referrer
+		pending.WebsiteID = caller.websiteID
 
-		// Check if the referrer is empty or null
-		if referrer == "" {
-			referrer = "Direct"
-		} else {
-			// Remove the protocol from the referrer
-			referrerURL, err := url.Parse(referrer)
+		// When the ingest queue is enabled the event is stored asynchronously in bulk by the queue workers
+		if ingestQueue != nil {
+			err = ingestQueue.EnqueueEvent(pending)
 			if err != nil {
-				log.Println("Error parsing referrer:", err)
-				http.Error(w, "Invalid referrer format", http.StatusBadRequest)
+				log.Println("Error enqueueing event:", err)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
 				return
 			}
-
-			referrer = referrerURL.Host + referrerURL.Path
+			w.WriteHeader(http.StatusAccepted)
+			return
 		}
 
-		// Look up the websiteId using the domain
-		var websiteId int
-		err = postgresDB.QueryRow("SELECT id FROM websites WHERE domain = $1", domain).Scan(&websiteId)
+		err = services.ResolveEvent(postgresDB, &pending)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// Website not registered - silently ignore the event
-				log.Printf("Ignoring event from unregistered domain: %s", domain)
+			if errors.Is(err, services.ErrUnregisteredDomain) || errors.Is(err, services.ErrFiltered) {
+				// Website not registered or event filtered out (e.g. bots) - silently ignore the event
 				w.WriteHeader(http.StatusOK)
 				return
 			}
-			// Handle other database errors
-			log.Printf("Database error looking up websiteId: %v", err)
+			if errors.Is(err, services.ErrWebsiteMismatch) {
+				http.Error(w, err.Error(), ingestErrorStatus(err))
+				return
+			}
+			log.Printf("Error resolving event for %s: %v", pending.Domain, err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		// Generate daily salt or grab from cache if already generated
-		dailySalt, err := utils.GenerateDailySalt()
+		// perform the INSERT query to insert the event into the database
+		err = services.InsertEvent(postgresDB, pending.Event)
 		if err != nil {
-			log.Println("Error generating or grabbing daily salt", err)
+			log.Println("Error inserting event", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		pending.GeoNamesCommitted()
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
 
-		// Generate a unique identifier
-		uniqueIdentifier, err := utils.GenerateUniqueIdentifier(dailySalt, domain, string(parsedIP), eventReceiver.UserAgent)
+// CreateEventsBatch ingests a JSON array or NDJSON stream of events in a single transaction and reports the outcome of each item
+func CreateEventsBatch(postgresDB *sql.DB, geolocator utils.Geolocator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := authenticateIngestRequest(postgresDB, r)
 		if err != nil {
-			log.Println("Error generating a unique identifier", err)
+			log.Println(err)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
 			return
 		}
 
-		// Check if the unique identifier exists in the daily_unique_identifiers table
-		var isUnique bool
-		err = postgresDB.QueryRow("SELECT EXISTS(SELECT 1 FROM daily_unique_identifiers WHERE unique_identifier = $1)", uniqueIdentifier).Scan(&isUnique)
+		items, err := decodeBatch(w, r)
 		if err != nil {
-			log.Println("Error checking for existing unique identifier", err)
+			log.Println("Error decoding batch:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		results := make([]models.BatchItemResult, len(items))
+		pendingEvents := make([]*services.PendingEvent, len(items))
+
+		// Parse every item first so nothing touches the database for payloads that are invalid
+		for i, item := range items {
+			results[i] = models.BatchItemResult{Index: i, Status: models.BatchItemAccepted}
+
+			var eventReceiver models.EventReceiver
+			if err := json.Unmarshal(item, &eventReceiver); err != nil {
+				results[i].Reject("Invalid JSON format")
+				continue
+			}
+
+			parsedIP, err := caller.visitorIP(eventReceiver.IP)
+			if err != nil {
+				results[i].Reject(err.Error())
+				continue
+			}
+			eventReceiver.Timestamp = caller.timestamp(eventReceiver.Timestamp)
+
+			pending, err := services.BuildEvent(geolocator, parsedIP, caller.locationHeader, caller.clientHints, eventReceiver, caller.serverSide())
+			if err != nil {
+				results[i].Reject(err.Error())
+				continue
+			}
+			pending.WebsiteID = caller.websiteID
+			pendingEvents[i] = &pending
+		}
+
+		tx, err := postgresDB.Begin()
+		if err != nil {
+			log.Println("Error beginning transaction:", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback() // no-op once the transaction has been committed
+
+		for i, pending := range pendingEvents {
+			if pending == nil {
+				continue
+			}
 
-		// Update the IsUnique field based on whether the unique identifier exists
-		if isUnique {
-			isUnique = false
-		} else {
-			// Add the unique identifier to the daily_unique_identifiers table
-			_, err := postgresDB.Exec("INSERT INTO daily_unique_identifiers (unique_identifier) VALUES ($1)", uniqueIdentifier)
+			err := services.ResolveEvent(tx, pending)
 			if err != nil {
-				log.Println("Error inserting unique identifier", err)
+				if errors.Is(err, services.ErrUnregisteredDomain) || errors.Is(err, services.ErrFiltered) || errors.Is(err, services.ErrWebsiteMismatch) {
+					results[i].Reject(err.Error())
+					continue
+				}
+				log.Printf("Error resolving event for %s: %v", pending.Domain, err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-			isUnique = true
-		}
-
-		event := models.EventInsert{
-			Type:       eventReceiver.Type,
-			Name:       eventReceiver.Name,
-			Timestamp:  eventReceiver.Timestamp,
-			Referrer:   referrer,
-			URL:        eventReceiver.URL,
-			Pathname:   eventReceiver.Pathname,
-			DeviceType: utils.GetDeviceType(&ua),
-			OS:         ua.OS,
-			Browser:    ua.Name,
-			Language:   eventReceiver.Language,
-			Country:    location.Country,
-			Region:     location.Region,
-			City:       location.City,
-			IsUnique:   isUnique,
-		}
 
-		// perform the INSERT query to insert the event into the database
-		insertQuery := `
-			INSERT INTO events 
-				(website_id, website_domain, type, name, timestamp, referrer, url, pathname, device_type, os, browser, language, country, region, city, is_unique)
-			VALUES
-				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-		`
+			err = services.InsertEvent(tx, pending.Event)
+			if err != nil {
+				log.Println("Error inserting event", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+		}
 
-		_, err = postgresDB.Exec(insertQuery,
-			websiteId,
-			domain,
-			event.Type,
-			event.Name,
-			event.Timestamp,
-			event.Referrer,
-			event.URL,
-			event.Pathname,
-			event.DeviceType,
-			event.OS,
-			event.Browser,
-			event.Language,
-			event.Country,
-			event.Region,
-			event.City,
-			event.IsUnique,
-		)
-		if err != nil {
-			log.Println("Error inserting event", err)
+		if err := tx.Commit(); err != nil {
+			log.Println("Error committing transaction:", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		for _, pending := range pendingEvents {
+			if pending != nil {
+				pending.GeoNamesCommitted()
+			}
+		}
 
-		w.WriteHeader(http.StatusCreated)
+		writeBatchResponse(w, results)
 	}
 }
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+func GetFunnels(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rows, err := db.Query("SELECT id, website_id, name, steps, window_minutes, created_at FROM funnels WHERE website_id = $1 ORDER BY id", websiteID)
+		if err != nil {
+			log.Println("Error querying funnels:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		defer rows.Close()
+
+		funnels := []models.Funnel{}
+		for rows.Next() {
+			funnel, err := scanFunnel(rows)
+			if err != nil {
+				log.Println("Error scanning funnel:", err)
+				utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+				return
+			}
+			funnels = append(funnels, funnel)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating funnels:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(funnels)
+	}
+}
+
+// CreateFunnel defines an ordered list of pageview and event steps for a website
+func CreateFunnel(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var funnelReceiver models.FunnelReceiver
+		if err := json.NewDecoder(r.Body).Decode(&funnelReceiver); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		funnelReceiver.Normalize()
+		if err := funnelReceiver.ValidateFunnel(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		steps, err := json.Marshal(funnelReceiver.Steps)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		funnel := models.Funnel{
+			WebsiteID:     websiteID,
+			Name:          funnelReceiver.Name,
+			Steps:         funnelReceiver.Steps,
+			WindowMinutes: funnelReceiver.WindowMinutes,
+		}
+		err = db.QueryRow(
+			"INSERT INTO funnels (website_id, name, steps, window_minutes) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+			funnel.WebsiteID, funnel.Name, string(steps), funnel.WindowMinutes,
+		).Scan(&funnel.ID, &funnel.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting funnel:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(funnel)
+	}
+}
+
+func DeleteFunnel(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		funnelID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM funnels
+			USING websites
+			WHERE websites.id = funnels.website_id AND websites.domain = $1 AND funnels.id = $2
+		`, domain, funnelID)
+		if err != nil {
+			log.Println("Error deleting funnel:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("funnel %d not found for website %s", funnelID, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Funnel deleted successfully",
+		})
+	}
+}
+
+// GetFunnelStats returns how many visitors reached each step of a funnel (funnelId query parameter) and the drop-off between steps. Steps are linked by the daily hashed visitor identifier: a visitor reaches a step if it happens after the previous one and within the funnel window from their first step. The standard filters select the visitors entering the funnel, a visitor is counted if they have a visit matching them in the range.
+func GetFunnelStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		funnelID, err := strconv.Atoi(r.URL.Query().Get("funnelId"))
+		if err != nil || funnelID <= 0 {
+			http.Error(w, "funnelId must be a positive number", http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		row := db.QueryRow(`
+			SELECT funnels.id, funnels.website_id, funnels.name, funnels.steps, funnels.window_minutes, funnels.created_at
+			FROM funnels
+			JOIN websites ON websites.id = funnels.website_id
+			WHERE websites.domain = $1 AND funnels.id = $2
+		`, domain, funnelID)
+		funnel, err := scanFunnel(row)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("funnel %d not found for website %s", funnelID, domain), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error querying funnel:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		params := []interface{}{domain, start, end, funnel.WindowMinutes}
+		paramIndex := 5 // Start the parameter index at 5 because $1 to $4 are already used
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Add filters to the visitors subquery
+		visitorConditions := ""
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				visitorConditions += fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		hitConditions := " AND website_domain = $1 AND timestamp BETWEEN $2 AND $3 AND visitor_id IS NOT NULL"
+		if visitorConditions != "" {
+			hitConditions += " AND visitor_id IN (SELECT visitor_id FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3" + visitorConditions + ")"
+		}
+
+		// Every pageview and event matching one of the steps, labelled with the step index. A visit is stored when the visitor leaves the page, so a pageview is reached at its timestamp minus the time spent on the page, as in assignSession.
+		var hits []string
+		for i, step := range funnel.Steps {
+			if step.Type == models.GoalTypePageview {
+				hits = append(hits, fmt.Sprintf("SELECT visitor_id, timestamp - GREATEST(time_spent_on_page, 0) * interval '1 millisecond' AS timestamp, %d AS step FROM visits WHERE pathname LIKE $%d%s", i, paramIndex, hitConditions))
+				params = append(params, step.PathnameLikePattern())
+			} else {
+				hits = append(hits, fmt.Sprintf("SELECT visitor_id, timestamp, %d AS step FROM events WHERE name = $%d%s", i, paramIndex, hitConditions))
+				params = append(params, step.EventName)
+			}
+			paramIndex++
+		}
+
+		// step_0 holds the first time each visitor reached the first step, every following step_n the first time they reached step n after step n-1 and within the window
+		query := "WITH hits AS (" + strings.Join(hits, " UNION ALL ") + "), step_0 AS (SELECT visitor_id, MIN(timestamp) AS started_at, MIN(timestamp) AS reached_at FROM hits WHERE step = 0 GROUP BY visitor_id)"
+		for i := 1; i < len(funnel.Steps); i++ {
+			query += fmt.Sprintf(`, step_%d AS (
+				SELECT previous.visitor_id, previous.started_at, MIN(hits.timestamp) AS reached_at
+				FROM step_%d AS previous
+				JOIN hits ON hits.visitor_id = previous.visitor_id AND hits.step = %d
+					AND hits.timestamp >= previous.reached_at AND hits.timestamp <= previous.started_at + make_interval(mins => $4::int)
+				GROUP BY previous.visitor_id, previous.started_at
+			)`, i, i-1, i)
+		}
+		counts := make([]string, len(funnel.Steps))
+		for i := range funnel.Steps {
+			counts[i] = fmt.Sprintf("(SELECT COUNT(*) FROM step_%d)", i)
+		}
+		query += " SELECT " + strings.Join(counts, ", ")
+
+		visitors := make([]int, len(funnel.Steps))
+		scanTargets := make([]interface{}, len(funnel.Steps))
+		for i := range visitors {
+			scanTargets[i] = &visitors[i]
+		}
+		if err := db.QueryRow(query, params...).Scan(scanTargets...); err != nil {
+			log.Println("Error getting funnel stats:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		steps := make([]string, len(funnel.Steps))
+		conversionRates := make([]float64, len(funnel.Steps)) // visitors of the step over visitors of the first step, in percent
+		dropOffs := make([]float64, len(funnel.Steps))        // visitors lost since the previous step, in percent
+		for i, step := range funnel.Steps {
+			steps[i] = step.Label()
+			if visitors[0] > 0 {
+				conversionRates[i] = percentage(visitors[i], visitors[0])
+			}
+			if i > 0 && visitors[i-1] > 0 {
+				dropOffs[i] = percentage(visitors[i-1]-visitors[i], visitors[i-1])
+			}
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"name":            funnel.Name,
+			"windowMinutes":   funnel.WindowMinutes,
+			"steps":           steps,
+			"visitors":        visitors,
+			"conversionRates": conversionRates,
+			"dropOffs":        dropOffs,
+			"totalCount":      len(steps),
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFunnel(row rowScanner) (models.Funnel, error) {
+	var funnel models.Funnel
+	var steps []byte
+	if err := row.Scan(&funnel.ID, &funnel.WebsiteID, &funnel.Name, &steps, &funnel.WindowMinutes, &funnel.CreatedAt); err != nil {
+		return funnel, err
+	}
+	err := json.Unmarshal(steps, &funnel.Steps)
+	return funnel, err
+}
+
+// percentage returns part over total in percent, rounded to two decimals
+func percentage(part, total int) float64 {
+	return math.Round(float64(part)/float64(total)*10000) / 100
+}
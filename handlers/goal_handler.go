@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+func GetGoals(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		goals, err := getWebsiteGoals(db, websiteID)
+		if err != nil {
+			log.Println("Error querying goals:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(goals)
+	}
+}
+
+// CreateGoal defines a new conversion goal, either a pageview of a pathname pattern or an event name with an optional property value
+func CreateGoal(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		goalReceiver, err := decodeGoalReceiver(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		goal := goalFromReceiver(goalReceiver)
+		goal.WebsiteID = websiteID
+		err = db.QueryRow(
+			"INSERT INTO goals (website_id, name, goal_type, pathname, event_name, property_key, property_value) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at",
+			goal.WebsiteID, goal.Name, goal.Type, goal.Pathname, goal.EventName, goal.PropertyKey, goal.PropertyValue,
+		).Scan(&goal.ID, &goal.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting goal:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(goal)
+	}
+}
+
+// UpdateGoal replaces the definition of a goal. Conversions are computed at query time, so the change applies to past data too.
+func UpdateGoal(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		goalID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		goalReceiver, err := decodeGoalReceiver(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		goal := goalFromReceiver(goalReceiver)
+		err = db.QueryRow(`
+			UPDATE goals
+			SET name = $3, goal_type = $4, pathname = $5, event_name = $6, property_key = $7, property_value = $8
+			FROM websites
+			WHERE websites.id = goals.website_id AND websites.domain = $1 AND goals.id = $2
+			RETURNING goals.id, goals.website_id, goals.created_at
+		`, domain, goalID, goal.Name, goal.Type, goal.Pathname, goal.EventName, goal.PropertyKey, goal.PropertyValue).Scan(&goal.ID, &goal.WebsiteID, &goal.CreatedAt)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("goal %d not found for website %s", goalID, domain))
+			return
+		} else if err != nil {
+			log.Println("Error updating goal:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(goal)
+	}
+}
+
+func DeleteGoal(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		goalID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM goals
+			USING websites
+			WHERE websites.id = goals.website_id AND websites.domain = $1 AND goals.id = $2
+		`, domain, goalID)
+		if err != nil {
+			log.Println("Error deleting goal:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("goal %d not found for website %s", goalID, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Goal deleted successfully",
+		})
+	}
+}
+
+// GetGoalConversions returns, for every goal of the website, the number of conversions, of unique converters and the conversion rate (unique converters over unique visitors, in percent). Visitors are identified by the daily hashed identifier, so like unique visitors a converter coming back on another day is counted again.
+func GetGoalConversions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the domain from the url
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Extract start and end dates from the request query parameters
+		startDate := r.URL.Query().Get("startDate")
+		endDate := r.URL.Query().Get("endDate")
+
+		// Convert the dates to a format suitable for my database
+		start, err := time.Parse("2006-01-02T15:04:05.999Z07:00", startDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := time.Parse("2006-01-02T15:04:05.999Z07:00", endDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("website with domain %s doesn't exist", domain), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		goals, err := getWebsiteGoals(db, websiteID)
+		if err != nil {
+			log.Println("Error querying goals:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Every query shares the first parameters, goal specific parameters are appended after the filters
+		params := []interface{}{domain, start, end}
+		paramIndex := 4
+
+		// Map query parameter names to column names
+		filters := map[string]string{
+			"referrer":     "referrer",
+			"source":       "referrer_source",
+			"pathname":     "pathname",
+			"hostname":     "hostname",
+			"channel":      "channel",
+			"device_type":  "device_type",
+			"os":           "os",
+			"browser":      "browser",
+			"language":     "language",
+			"country":      "country",
+			"city":         "city",
+			"city_id":      "city_geoname_id::text",
+			"region":       "region",
+			"region_id":    "region_geoname_id::text",
+			"utm_source":   "utm_source",
+			"utm_medium":   "utm_medium",
+			"utm_campaign": "utm_campaign",
+			"utm_term":     "utm_term",
+			"utm_content":  "utm_content",
+		}
+
+		// Columns that events have too, the other filters only exist on visits
+		eventColumns := map[string]bool{
+			"referrer":    true,
+			"pathname":    true,
+			"device_type": true,
+			"os":          true,
+			"browser":     true,
+			"language":    true,
+			"country":     true,
+			"city":        true,
+			"region":      true,
+		}
+
+		// Add filters to the conditions
+		var visitConditions, eventConditions, visitOnlyConditions string
+		for param, column := range filters {
+			value := r.URL.Query().Get(param)
+			if value != "" {
+				condition := fmt.Sprintf(" AND %s = $%d", column, paramIndex)
+				visitConditions += condition
+				if eventColumns[column] {
+					eventConditions += condition
+				} else {
+					visitOnlyConditions += condition
+				}
+				params = append(params, value)
+				paramIndex++
+			}
+		}
+
+		// An event converts if its visitor had a visit matching the visit only filters (e.g. utm_source) in the same range
+		if visitOnlyConditions != "" {
+			eventConditions += " AND visitor_id IN (SELECT visitor_id FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3" + visitOnlyConditions + ")"
+		}
+
+		// Visitors are counted by visitor_id rather than is_unique, which is set on the first hit of the day only and that can be an event
+		var uniqueVisitors int
+		err = db.QueryRow("SELECT COUNT(DISTINCT visitor_id) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3"+visitConditions, params...).Scan(&uniqueVisitors)
+		if err != nil {
+			log.Println("Error getting unique visitors:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		ids := []int{}
+		names := []string{}
+		conversions := []int{}
+		uniqueConverters := []int{}
+		conversionRates := []float64{}
+
+		for _, goal := range goals {
+			var query string
+			goalParams := append([]interface{}{}, params...)
+
+			if goal.Type == models.GoalTypePageview {
+				query = fmt.Sprintf("SELECT COUNT(*), COUNT(DISTINCT visitor_id) FROM visits WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3%s AND pathname LIKE $%d", visitConditions, paramIndex)
+				goalParams = append(goalParams, goal.PathnameLikePattern())
+			} else {
+				query = fmt.Sprintf("SELECT COUNT(*), COUNT(DISTINCT visitor_id) FROM events WHERE website_domain = $1 AND timestamp BETWEEN $2 AND $3%s AND name = $%d", eventConditions, paramIndex)
+				goalParams = append(goalParams, goal.EventName)
+				if goal.PropertyKey != "" {
+					query += fmt.Sprintf(" AND properties ->> $%d = $%d", paramIndex+1, paramIndex+2)
+					goalParams = append(goalParams, goal.PropertyKey, goal.PropertyValue)
+				}
+			}
+
+			var count, unique int
+			if err := db.QueryRow(query, goalParams...).Scan(&count, &unique); err != nil {
+				log.Println("Error getting goal conversions:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			rate := 0.0
+			if uniqueVisitors > 0 {
+				rate = percentage(unique, uniqueVisitors)
+			}
+
+			ids = append(ids, goal.ID)
+			names = append(names, goal.Name)
+			conversions = append(conversions, count)
+			uniqueConverters = append(uniqueConverters, unique)
+			conversionRates = append(conversionRates, rate)
+		}
+
+		// Prepare and send the JSON response
+		jsonStats, err := json.Marshal(map[string]interface{}{
+			"ids":              ids,
+			"goals":            names,
+			"conversions":      conversions,
+			"uniqueConverters": uniqueConverters,
+			"conversionRates":  conversionRates,
+			"uniqueVisitors":   uniqueVisitors,
+			"totalCount":       len(goals),
+		})
+		if err != nil {
+			log.Println("Error marshalling statistics:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonStats)
+	}
+}
+
+func decodeGoalReceiver(r *http.Request) (models.GoalReceiver, error) {
+	var goalReceiver models.GoalReceiver
+	if err := json.NewDecoder(r.Body).Decode(&goalReceiver); err != nil {
+		log.Println("Error decoding JSON:", err)
+		return goalReceiver, errors.New("invalid request format")
+	}
+
+	goalReceiver.Name = strings.TrimSpace(goalReceiver.Name)
+	goalReceiver.Type = strings.ToLower(strings.TrimSpace(goalReceiver.Type))
+	goalReceiver.Pathname = strings.TrimSpace(goalReceiver.Pathname)
+	goalReceiver.EventName = strings.TrimSpace(goalReceiver.EventName)
+	goalReceiver.PropertyKey = strings.TrimSpace(goalReceiver.PropertyKey)
+
+	return goalReceiver, goalReceiver.ValidateGoal()
+}
+
+func goalFromReceiver(goalReceiver models.GoalReceiver) models.Goal {
+	return models.Goal{
+		Name:          goalReceiver.Name,
+		Type:          goalReceiver.Type,
+		Pathname:      goalReceiver.Pathname,
+		EventName:     goalReceiver.EventName,
+		PropertyKey:   goalReceiver.PropertyKey,
+		PropertyValue: goalReceiver.PropertyValue,
+	}
+}
+
+func getWebsiteGoals(db *sql.DB, websiteID int) ([]models.Goal, error) {
+	rows, err := db.Query(`
+		SELECT id, website_id, name, goal_type, pathname, event_name, property_key, property_value, created_at
+		FROM goals
+		WHERE website_id = $1
+		ORDER BY id
+	`, websiteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	goals := []models.Goal{}
+	for rows.Next() {
+		var goal models.Goal
+		if err := rows.Scan(&goal.ID, &goal.WebsiteID, &goal.Name, &goal.Type, &goal.Pathname, &goal.EventName, &goal.PropertyKey, &goal.PropertyValue, &goal.CreatedAt); err != nil {
+			return nil, err
+		}
+		goals = append(goals, goal)
+	}
+
+	return goals, rows.Err()
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	_ "github.com/lib/pq"
+)
+
+// openTestDB connects to the Postgres database named by TEST_DATABASE_URL, skipping the test if it isn't set. The connection pool holds a single connection, so the temporary tables created by the test shadow the real ones for every query it runs.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	return db
+}
+
+func TestGetGoalConversionsEventFirstVisitor(t *testing.T) {
+	db := openTestDB(t)
+
+	_, err := db.Exec(`
+		CREATE TEMP TABLE websites (id SERIAL PRIMARY KEY, domain TEXT NOT NULL);
+		CREATE TEMP TABLE goals (
+			id SERIAL PRIMARY KEY, website_id INTEGER NOT NULL, name TEXT NOT NULL, goal_type TEXT NOT NULL,
+			pathname TEXT NOT NULL DEFAULT '', event_name TEXT NOT NULL DEFAULT '', property_key TEXT NOT NULL DEFAULT '', property_value TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		CREATE TEMP TABLE visits (website_domain TEXT, timestamp TIMESTAMPTZ, pathname TEXT, visitor_id TEXT, is_unique BOOLEAN);
+		CREATE TEMP TABLE events (website_domain TEXT, timestamp TIMESTAMPTZ, name TEXT, pathname TEXT, visitor_id TEXT, is_unique BOOLEAN, properties JSONB);
+
+		INSERT INTO websites (domain) VALUES ('example.com');
+		INSERT INTO goals (website_id, name, goal_type, event_name) VALUES (1, 'Signup', 'event', 'signup');
+
+		-- The first hit of the day of visitor a is an event, so none of its visits is marked unique
+		INSERT INTO events VALUES ('example.com', '2024-05-01 10:00:00+00', 'signup', '/', 'a', true, '{}');
+		INSERT INTO visits VALUES ('example.com', '2024-05-01 10:01:00+00', '/', 'a', false);
+		INSERT INTO visits VALUES ('example.com', '2024-05-01 11:00:00+00', '/', 'b', true);
+		INSERT INTO visits VALUES ('example.com', '2024-05-01 11:05:00+00', '/pricing', 'b', false);
+	`)
+	if err != nil {
+		t.Fatalf("setting up tables: %v", err)
+	}
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24*time.Hour - time.Millisecond)
+	r := httptest.NewRequest(http.MethodGet, "/api/dashboard/goals/example.com?startDate="+start.Format(time.RFC3339Nano)+"&endDate="+end.Format(time.RFC3339Nano), nil)
+	r = mux.SetURLVars(r, map[string]string{"domain": "example.com"})
+	w := httptest.NewRecorder()
+
+	GetGoalConversions(db).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		UniqueVisitors   int       `json:"uniqueVisitors"`
+		UniqueConverters []int     `json:"uniqueConverters"`
+		ConversionRates  []float64 `json:"conversionRates"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	if response.UniqueVisitors != 2 {
+		t.Errorf("uniqueVisitors = %d, want 2", response.UniqueVisitors)
+	}
+	if len(response.ConversionRates) != 1 || response.UniqueConverters[0] != 1 || response.ConversionRates[0] != 50 {
+		t.Errorf("uniqueConverters = %v, conversionRates = %v, want [1] and [50]", response.UniqueConverters, response.ConversionRates)
+	}
+}
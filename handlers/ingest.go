@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mvavassori/flockcounter/middleware"
+	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/services"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+const (
+	maxBatchItems     = 1000
+	maxBatchBodyBytes = 5 << 20 // 5 MB
+)
+
+// ingestKeyHeader carries the ingest key of server-side requests
+const ingestKeyHeader = "X-Ingest-Key"
+
+var (
+	errNoIPAddress      = errors.New("Could not determine IP address")
+	errInvalidIP        = errors.New("Invalid IP format")
+	errMissingVisitorIP = errors.New("ip is required for server-side hits")
+)
+
+// ingestCaller tells browser hits apart from server-side hits sent by a backend with an ingest key
+type ingestCaller struct {
+	websiteID      int               // website of the ingest key, 0 for browser hits
+	clientIP       net.IP            // IP the browser request came from, unused for server-side hits
+	locationHeader http.Header       // headers the geolocation provider can read, only set for browser hits coming through a trusted proxy
+	clientHints    utils.ClientHints // User-Agent Client Hints of the browser, empty for server-side hits
+}
+
+// authenticateIngestRequest checks the ingest key of server-side requests, reusing the result of the Ingest middleware when it has already authenticated it. Requests without a key are browser hits and keep working as usual.
+func authenticateIngestRequest(db *sql.DB, r *http.Request) (ingestCaller, error) {
+	if key := r.Header.Get(ingestKeyHeader); key != "" {
+		auth, ok := r.Context().Value(middleware.IngestKeyAuthKey).(middleware.IngestKeyAuth)
+		if !ok {
+			auth.WebsiteID, auth.Err = services.AuthenticateIngestKey(db, key)
+		}
+		if auth.Err != nil {
+			return ingestCaller{}, auth.Err
+		}
+		return ingestCaller{websiteID: auth.WebsiteID}, nil
+	}
+
+	clientIP, err := resolveClientIP(r)
+	if err != nil {
+		return ingestCaller{}, err
+	}
+	caller := ingestCaller{clientIP: clientIP, clientHints: utils.ParseClientHints(r.Header)}
+	if utils.FromTrustedProxy(r) {
+		caller.locationHeader = r.Header
+	}
+	return caller, nil
+}
+
+func (c ingestCaller) serverSide() bool {
+	return c.websiteID != 0
+}
+
+// visitorIP returns the IP the hit is attributed to. Browser hits use the IP of the request, server-side hits have to name the visitor IP in the payload since the request comes from the backend.
+func (c ingestCaller) visitorIP(payloadIP string) (net.IP, error) {
+	if !c.serverSide() {
+		return c.clientIP, nil
+	}
+
+	if payloadIP == "" {
+		return nil, errMissingVisitorIP
+	}
+	parsedIP := net.ParseIP(payloadIP)
+	if parsedIP == nil {
+		return nil, errInvalidIP
+	}
+	return parsedIP, nil
+}
+
+// timestamp defaults the timestamp of server-side hits to the time they are received
+func (c ingestCaller) timestamp(payloadTimestamp time.Time) time.Time {
+	if c.serverSide() && payloadTimestamp.IsZero() {
+		return time.Now()
+	}
+	return payloadTimestamp
+}
+
+// resolveClientIP returns the IP address of the visitor. Outside of production a fixed test IP is used so that GeoIP lookups return something meaningful.
+func resolveClientIP(r *http.Request) (net.IP, error) {
+	var parsedIP net.IP
+	if os.Getenv("ENV") == "production" {
+		// Try different headers first, then fall back to RemoteAddr
+		ipAddress := utils.GetIPAddress(r)
+		if ipAddress == "" {
+			return nil, errNoIPAddress
+		}
+		parsedIP = net.ParseIP(ipAddress)
+	} else {
+		parsedIP = net.ParseIP("151.30.13.167") // test IP
+	}
+
+	if parsedIP == nil {
+		return nil, errInvalidIP
+	}
+
+	return parsedIP, nil
+}
+
+// ingestErrorStatus maps the errors returned while authenticating, parsing or resolving a visit or an event to an http status code
+func ingestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoIPAddress),
+		errors.Is(err, errInvalidIP),
+		errors.Is(err, errMissingVisitorIP),
+		errors.Is(err, services.ErrInvalidURL),
+		errors.Is(err, services.ErrInvalidReferrer),
+		errors.Is(err, services.ErrInvalidProperties),
+		errors.Is(err, services.ErrMissingUserAgent):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrInvalidIngestKey):
+		return http.StatusUnauthorized
+	case errors.Is(err, services.ErrWebsiteMismatch):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// decodeBatch splits the request body into its raw items. The body can either be a JSON array or newline delimited JSON (one object per line).
+func decodeBatch(w http.ResponseWriter, r *http.Request) ([]json.RawMessage, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes))
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	var items []json.RawMessage
+	if body[0] == '[' {
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, errors.New("invalid JSON array")
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxBatchBodyBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			// copy the line, the scanner reuses its buffer
+			items = append(items, json.RawMessage(append([]byte(nil), line...)))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading NDJSON body: %w", err)
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	if len(items) > maxBatchItems {
+		return nil, fmt.Errorf("batch cannot contain more than %d items", maxBatchItems)
+	}
+
+	return items, nil
+}
+
+func writeBatchResponse(w http.ResponseWriter, results []models.BatchItemResult) {
+	response := models.BatchResponse{Results: results}
+	for _, result := range results {
+		if result.Status == models.BatchItemAccepted {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+
+	jsonResponse, err := json.Marshal(response)
+	if err != nil {
+		log.Println("Error encoding JSON:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// GetIngestQueueStats exposes the depth and the counters of the asynchronous ingest queue
+func GetIngestQueueStats(ingestQueue *services.IngestQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := map[string]interface{}{
+			"enabled": ingestQueue != nil,
+		}
+		if ingestQueue != nil {
+			response["stats"] = ingestQueue.Stats()
+		}
+
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			log.Println("Error encoding JSON:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(jsonResponse)
+	}
+}
+
+// ReloadGeoIPDatabase swaps in the GeoIP database file again without restarting the server, e.g. right after it has been updated. An invalid file is rejected and the current database keeps being used. It's routed for the city database when the geolocation provider uses one, and for the ASN database when it's configured.
+func ReloadGeoIPDatabase(geoipDB *utils.GeoIPDatabase) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := geoipDB.Reload(); err != nil {
+			log.Println("Error reloading GeoIP database:", err)
+			utils.WriteErrorResponse(w, http.StatusUnprocessableEntity, errors.New("invalid GeoIP database, the current one is still in use"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":      geoipDB.Path(),
+			"buildTime": geoipDB.BuildTime(),
+		})
+	}
+}
+
+// ReloadReferrerSpamList reloads the referrer spam list from the file at REFERRER_SPAM_LIST_PATH (or the bundled list if it isn't set) without restarting the server
+func ReloadReferrerSpamList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := os.Getenv("REFERRER_SPAM_LIST_PATH")
+
+		count, err := utils.LoadReferrerSpamList(path)
+		if err != nil {
+			log.Println("Error reloading referrer spam list:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("error reading the referrer spam list"))
+			return
+		}
+
+		source := path
+		if source == "" {
+			source = "bundled"
+		}
+		log.Printf("Loaded %d referrer spam domains (%s)", count, source)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"domains": count,
+			"source":  source,
+		})
+	}
+}
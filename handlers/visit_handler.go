@@ -3,22 +3,17 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"strconv"
-	"strings"
 
 	"log"
-	"net"
 	"net/http"
-	"net/url"
 
 	_ "github.com/lib/pq"
-	"github.com/mileusna/useragent"
 	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/services"
 	"github.com/mvavassori/flockcounter/utils"
-
-	"github.com/oschwald/geoip2-golang"
 )
 
 func GetVisits(postgresDB *sql.DB) http.HandlerFunc {
@@ -35,7 +30,7 @@ func GetVisits(postgresDB *sql.DB) http.HandlerFunc {
 
 		// Prepare the SQL query with LIMIT and OFFSET for pagination
 		query := `
-			SELECT id, website_id, website_domain, timestamp, referrer, url, pathname, device_type, os, browser, language, country, region, city, time_spent_on_page, is_unique, utm_source, utm_medium, utm_campaign, utm_term, utm_content
+			SELECT id, website_id, website_domain, timestamp, referrer, COALESCE(referrer_source, ''), url, COALESCE(hostname, ''), pathname, device_type, os, COALESCE(os_version, ''), browser, COALESCE(browser_version, ''), COALESCE(screen_size, ''), language, country, region, city, COALESCE(country_code, ''), COALESCE(region_code, ''), COALESCE(continent, ''), COALESCE(asn, 0), COALESCE(asn_organization, ''), is_datacenter, time_spent_on_page, is_unique, utm_source, utm_medium, utm_campaign, utm_term, utm_content, COALESCE(channel, ''), scroll_depth, lcp, cls, inp, fcp, ttfb
 			FROM visits
 			ORDER BY timestamp DESC
 			LIMIT $1 OFFSET $2
@@ -55,7 +50,7 @@ func GetVisits(postgresDB *sql.DB) http.HandlerFunc {
 		// Loop through rows, using Scan to assign column data to struct fields.
 		for rows.Next() {
 			var visit models.Visit
-			err := rows.Scan(&visit.ID, &visit.WebsiteID, &visit.WebsiteDomain, &visit.Timestamp, &visit.Referrer, &visit.URL, &visit.Pathname, &visit.DeviceType, &visit.OS, &visit.Browser, &visit.Language, &visit.Country, &visit.Region, &visit.City, &visit.TimeSpentOnPage, &visit.IsUnique, &visit.UTMSource, &visit.UTMMedium, &visit.UTMCampaign, &visit.UTMTerm, &visit.UTMContent)
+			err := rows.Scan(&visit.ID, &visit.WebsiteID, &visit.WebsiteDomain, &visit.Timestamp, &visit.Referrer, &visit.ReferrerSource, &visit.URL, &visit.Hostname, &visit.Pathname, &visit.DeviceType, &visit.OS, &visit.OSVersion, &visit.Browser, &visit.BrowserVersion, &visit.ScreenSize, &visit.Language, &visit.Country, &visit.Region, &visit.City, &visit.CountryCode, &visit.RegionCode, &visit.Continent, &visit.ASN, &visit.ASNOrg, &visit.IsDatacenter, &visit.TimeSpentOnPage, &visit.IsUnique, &visit.UTMSource, &visit.UTMMedium, &visit.UTMCampaign, &visit.UTMTerm, &visit.UTMContent, &visit.Channel, &visit.ScrollDepth, &visit.LCP, &visit.CLS, &visit.INP, &visit.FCP, &visit.TTFB)
 			if err != nil {
 				log.Println("Error scanning visit:", err)
 				http.Error(w, "Error scanning visit", http.StatusInternalServerError)
@@ -86,37 +81,15 @@ func GetVisits(postgresDB *sql.DB) http.HandlerFunc {
 	}
 }
 
-func CreateVisit(postgresDB *sql.DB, geoipDB *geoip2.Reader) http.HandlerFunc {
+func CreateVisit(postgresDB *sql.DB, geolocator utils.Geolocator, ingestQueue *services.IngestQueue) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var parsedIP net.IP
-		if os.Getenv("ENV") == "production" {
-			// Try different headers first, then fall back to RemoteAddr
-			ipAddress := utils.GetIPAddress(r)
-			if ipAddress == "" {
-				log.Println("Could not determine IP address")
-				http.Error(w, "Could not determine IP address", http.StatusInternalServerError)
-				return
-			}
-			parsedIP = net.ParseIP(ipAddress)
-		} else {
-			parsedIP = net.ParseIP("151.30.13.167") // test IP
-		}
-
-		if parsedIP == nil {
-			log.Println("Invalid IP format")
-			http.Error(w, "Invalid IP format", http.StatusBadRequest)
-			return
-		}
-
-		record, err := geoipDB.City(parsedIP)
+		caller, err := authenticateIngestRequest(postgresDB, r)
 		if err != nil {
-			log.Printf("Error retrieving location for IP %v: %v", parsedIP, err)
-			http.Error(w, "Error retrieving location", http.StatusInternalServerError)
+			log.Println(err)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
 			return
 		}
 
-		location := utils.GetLocationInfo(record)
-
 		// Create a VisitReceiver struct to hold the request data
 		var visitReceiver models.VisitReceiver
 
@@ -128,190 +101,172 @@ func CreateVisit(postgresDB *sql.DB, geoipDB *geoip2.Reader) http.HandlerFunc {
 			return
 		}
 
-		ua := useragent.Parse(visitReceiver.UserAgent)
+		parsedIP, err := caller.visitorIP(visitReceiver.IP)
+		if err != nil {
+			http.Error(w, err.Error(), ingestErrorStatus(err))
+			return
+		}
+		visitReceiver.Timestamp = caller.timestamp(visitReceiver.Timestamp)
 
-		url, err := url.Parse(visitReceiver.URL)
+		pending, err := services.BuildVisit(geolocator, parsedIP, caller.locationHeader, caller.clientHints, visitReceiver, caller.serverSide())
 		if err != nil {
-			log.Println("Error parsing URL", err)
-			http.Error(w, "Invalid URL format", http.StatusBadRequest)
+			log.Println("Error building visit:", err)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
 			return
 		}
 
-		domain := url.Hostname()
+		pending.WebsiteID = caller.websiteID
 
-		// Determine the alternative domain form (add or remove www.)
-		var alternativeDomain string
-		if strings.HasPrefix(domain, "www.") {
-			alternativeDomain = strings.TrimPrefix(domain, "www.")
-		} else {
-			alternativeDomain = "www." + domain
+		// When the ingest queue is enabled the visit is stored asynchronously in bulk by the queue workers
+		if ingestQueue != nil {
+			err = ingestQueue.EnqueueVisit(pending)
+			if err != nil {
+				log.Println("Error enqueueing visit:", err)
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
 		}
 
-		// Look up the websiteId using either the original domain or the alternative
-		var websiteId int
-		var registeredDomain string // store the domain as it is registered in the db
-
-		// The ORDER BY line ensures that if both domain.com ($1) and www.domain.com ($2) exist, it will always return domain.com first
-		query := `
-			SELECT id, domain
-			FROM websites
-			WHERE domain = $1 OR domain = $2
-			ORDER BY (CASE WHEN domain = $1 THEN 1 ELSE 2 END)
-			LIMIT 1
-		`
+		// The visit is resolved and inserted in a single transaction, which holds the session lock of the visitor until the visit is stored
+		tx, err := postgresDB.Begin()
+		if err != nil {
+			log.Println("Error beginning transaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback() // no-op once the transaction has been committed
 
-		err = postgresDB.QueryRow(query, domain, alternativeDomain).Scan(&websiteId, &registeredDomain)
+		err = services.ResolveVisit(tx, &pending)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				// Website not registered - silently ignore the visit
-				log.Printf("Ignoring visit from unregistered domain (checked %s and %s)", domain, alternativeDomain)
+			if errors.Is(err, services.ErrUnregisteredDomain) || errors.Is(err, services.ErrFiltered) {
+				// Website not registered or visit filtered out (e.g. bots) - silently ignore the visit, keeping the count of filtered hits
+				if err := tx.Commit(); err != nil {
+					log.Println("Error committing transaction:", err)
+				}
 				w.WriteHeader(http.StatusOK)
 				return
 			}
-			// Handle other database errors
-			log.Printf("Database error looking up websiteId for %s/%s: %v", domain, alternativeDomain, err)
+			if errors.Is(err, services.ErrWebsiteMismatch) {
+				http.Error(w, err.Error(), ingestErrorStatus(err))
+				return
+			}
+			log.Printf("Error resolving visit for %s: %v", pending.Domain, err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 
-		utmSource := url.Query().Get("utm_source")
-		utmMedium := url.Query().Get("utm_medium")
-		utmCampaign := url.Query().Get("utm_campaign")
-		utmTerm := url.Query().Get("utm_term")
-		utmContent := url.Query().Get("utm_content")
-
-		// extract the referrer
-		referrer := visitReceiver.Referrer
-
-		// Check if the referrer is empty or null
-		if referrer == "" {
-			referrer = "Direct"
-		} else if referrer == "Direct" {
-			// Explicitly handle the case where the referrer is "Direct" (my script sends it when ther's no referrer)
-			referrer = "Direct"
-		} else {
-			// Remove the protocol from the referrer
-			referrerURL, err := url.Parse(referrer)
-			if err != nil {
-				log.Println("Error parsing referrer:", err)
-				http.Error(w, "Invalid referrer format", http.StatusBadRequest)
-				return
-			}
+		// Perform the INSERT query to add the new visit to the database
+		err = services.InsertVisit(tx, pending.Visit)
+		if err != nil {
+			log.Println("Error inserting visit:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
-			referrer = referrerURL.Host + referrerURL.Path
+		if err := tx.Commit(); err != nil {
+			log.Println("Error committing transaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
+		pending.GeoNamesCommitted()
 
-		// Generate daily salt or grab from cache if already generated
-		dailySalt, err := utils.GenerateDailySalt()
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// CreateVisitsBatch ingests a JSON array or NDJSON stream of visits in a single transaction and reports the outcome of each item
+func CreateVisitsBatch(postgresDB *sql.DB, geolocator utils.Geolocator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := authenticateIngestRequest(postgresDB, r)
 		if err != nil {
-			log.Println("Error generating or grabbing daily salt", err)
+			log.Println(err)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
 			return
 		}
 
-		// Generate a unique identifier
-		uniqueIdentifier, err := utils.GenerateUniqueIdentifier(dailySalt, registeredDomain, string(parsedIP), visitReceiver.UserAgent)
+		items, err := decodeBatch(w, r)
 		if err != nil {
-			log.Println("Error generating a unique identifier", err)
+			log.Println("Error decoding batch:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Check if the unique identifier exists in the daily_unique_identifiers table
-		var isUnique bool
-		err = postgresDB.QueryRow("SELECT EXISTS(SELECT 1 FROM daily_unique_identifiers WHERE unique_identifier = $1)", uniqueIdentifier).Scan(&isUnique)
+		results := make([]models.BatchItemResult, len(items))
+		pendingVisits := make([]*services.PendingVisit, len(items))
+
+		// Parse every item first so nothing touches the database for payloads that are invalid
+		for i, item := range items {
+			results[i] = models.BatchItemResult{Index: i, Status: models.BatchItemAccepted}
+
+			var visitReceiver models.VisitReceiver
+			if err := json.Unmarshal(item, &visitReceiver); err != nil {
+				results[i].Reject("Invalid JSON format")
+				continue
+			}
+
+			parsedIP, err := caller.visitorIP(visitReceiver.IP)
+			if err != nil {
+				results[i].Reject(err.Error())
+				continue
+			}
+			visitReceiver.Timestamp = caller.timestamp(visitReceiver.Timestamp)
+
+			pending, err := services.BuildVisit(geolocator, parsedIP, caller.locationHeader, caller.clientHints, visitReceiver, caller.serverSide())
+			if err != nil {
+				results[i].Reject(err.Error())
+				continue
+			}
+			pending.WebsiteID = caller.websiteID
+			pendingVisits[i] = &pending
+		}
+
+		tx, err := postgresDB.Begin()
 		if err != nil {
-			log.Println("Error checking for existing unique identifier", err)
+			log.Println("Error beginning transaction:", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback() // no-op once the transaction has been committed
 
-		// Update the IsUnique field based on whether the unique identifier exists
-		if isUnique {
-			isUnique = false
-		} else {
-			// Add the unique identifier to the daily_unique_identifiers table
-			_, err := postgresDB.Exec("INSERT INTO daily_unique_identifiers (unique_identifier) VALUES ($1)", uniqueIdentifier)
+		for i, pending := range pendingVisits {
+			if pending == nil {
+				continue
+			}
+
+			err := services.ResolveVisit(tx, pending)
 			if err != nil {
-				log.Println("Error inserting unique identifier", err)
+				if errors.Is(err, services.ErrUnregisteredDomain) || errors.Is(err, services.ErrFiltered) || errors.Is(err, services.ErrWebsiteMismatch) {
+					results[i].Reject(err.Error())
+					continue
+				}
+				log.Printf("Error resolving visit for %s: %v", pending.Domain, err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-			isUnique = true
-		}
 
-		// Create a VisitInsert struct to hold the data to be inserted into the database
-		visit := models.VisitInsert{
-			WebsiteID:       websiteId,
-			WebsiteDomain:   registeredDomain,
-			Timestamp:       visitReceiver.Timestamp,
-			Referrer:        referrer,
-			URL:             visitReceiver.URL,
-			Pathname:        visitReceiver.Pathname,
-			DeviceType:      utils.GetDeviceType(&ua),
-			OS:              ua.OS,
-			Browser:         ua.Name,
-			Language:        visitReceiver.Language,
-			Country:         location.Country,
-			Region:          location.Region,
-			City:            location.City,
-			IsUnique:        isUnique,
-			TimeSpentOnPage: visitReceiver.TimeSpentOnPage,
-			UTMSource: sql.NullString{
-				String: utmSource,
-				Valid:  utmSource != "",
-			},
-			UTMMedium: sql.NullString{
-				String: utmMedium,
-				Valid:  utmMedium != "",
-			},
-			UTMCampaign: sql.NullString{
-				String: utmCampaign,
-				Valid:  utmCampaign != "",
-			},
-			UTMTerm: sql.NullString{
-				String: utmTerm,
-				Valid:  utmTerm != "",
-			},
-			UTMContent: sql.NullString{
-				String: utmContent,
-				Valid:  utmContent != "",
-			},
+			err = services.InsertVisit(tx, pending.Visit)
+			if err != nil {
+				log.Println("Error inserting visit:", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		// Perform the INSERT query to add the new visit to the database
-		insertQuery := `
-			INSERT INTO visits
-				(website_id, website_domain, timestamp, referrer, url, pathname, device_type, os, browser, language, country, region, city, is_unique, time_spent_on_page, utm_source, utm_medium, utm_campaign, utm_term, utm_content)
-			VALUES
-				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20);
-		`
-		_, err = postgresDB.Exec(insertQuery,
-			visit.WebsiteID,
-			visit.WebsiteDomain,
-			visit.Timestamp,
-			visit.Referrer,
-			visit.URL,
-			visit.Pathname,
-			visit.DeviceType,
-			visit.OS,
-			visit.Browser,
-			visit.Language,
-			visit.Country,
-			visit.Region,
-			visit.City,
-			visit.IsUnique,
-			visit.TimeSpentOnPage,
-			visit.UTMSource,
-			visit.UTMMedium,
-			visit.UTMCampaign,
-			visit.UTMTerm,
-			visit.UTMContent,
-		)
-		if err != nil {
-			log.Println("Error inserting visit:", err)
+		if err := tx.Commit(); err != nil {
+			log.Println("Error committing transaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		for _, pending := range pendingVisits {
+			if pending != nil {
+				pending.GeoNamesCommitted()
+			}
+		}
 
-		w.WriteHeader(http.StatusCreated)
+		writeBatchResponse(w, results)
 	}
 }
 
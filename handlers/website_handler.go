@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mvavassori/flockcounter/middleware"
 	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/services"
 	"github.com/mvavassori/flockcounter/utils"
 )
 
@@ -283,6 +285,962 @@ func DeleteWebsite(db *sql.DB) http.HandlerFunc {
 	}
 }
 
+func GetWebsiteSettings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		settings, err := getWebsiteSettings(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website settings:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(settings)
+	}
+}
+
+func UpdateWebsiteSettings(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var settingsUpdate models.WebsiteSettingsUpdate
+		if err := json.NewDecoder(r.Body).Decode(&settingsUpdate); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		// Only update the settings that were sent
+		var setClauses []string
+		var params []interface{}
+		if settingsUpdate.KeepBots != nil {
+			params = append(params, *settingsUpdate.KeepBots)
+			setClauses = append(setClauses, fmt.Sprintf("keep_bots = $%d", len(params)))
+		}
+		if settingsUpdate.LowercasePaths != nil {
+			params = append(params, *settingsUpdate.LowercasePaths)
+			setClauses = append(setClauses, fmt.Sprintf("lowercase_paths = $%d", len(params)))
+		}
+		if settingsUpdate.StripTrailingSlash != nil {
+			params = append(params, *settingsUpdate.StripTrailingSlash)
+			setClauses = append(setClauses, fmt.Sprintf("strip_trailing_slash = $%d", len(params)))
+		}
+		if settingsUpdate.CollapseIndex != nil {
+			params = append(params, *settingsUpdate.CollapseIndex)
+			setClauses = append(setClauses, fmt.Sprintf("collapse_index = $%d", len(params)))
+		}
+		if settingsUpdate.HashRouting != nil {
+			params = append(params, *settingsUpdate.HashRouting)
+			setClauses = append(setClauses, fmt.Sprintf("hash_routing = $%d", len(params)))
+		}
+		if settingsUpdate.ExcludeDatacenter != nil {
+			params = append(params, *settingsUpdate.ExcludeDatacenter)
+			setClauses = append(setClauses, fmt.Sprintf("exclude_datacenter = $%d", len(params)))
+		}
+
+		if len(setClauses) == 0 {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("no settings to update"))
+			return
+		}
+
+		params = append(params, time.Now())
+		setClauses = append(setClauses, fmt.Sprintf("updated_at = $%d", len(params)))
+		params = append(params, domain)
+
+		query := fmt.Sprintf("UPDATE websites SET %s WHERE domain = $%d", strings.Join(setClauses, ", "), len(params))
+		result, err := db.Exec(query, params...)
+		if err != nil {
+			log.Println("Error updating website settings:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		}
+
+		settings, err := getWebsiteSettings(db, domain)
+		if err != nil {
+			log.Println("Error querying website settings:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(settings)
+	}
+}
+
+func getWebsiteSettings(db *sql.DB, domain string) (models.WebsiteSettings, error) {
+	var settings models.WebsiteSettings
+	err := db.QueryRow("SELECT keep_bots, lowercase_paths, strip_trailing_slash, collapse_index, hash_routing, exclude_datacenter FROM websites WHERE domain = $1", domain).Scan(&settings.KeepBots, &settings.LowercasePaths, &settings.StripTrailingSlash, &settings.CollapseIndex, &settings.HashRouting, &settings.ExcludeDatacenter)
+	return settings, err
+}
+
+func GetWebsiteHostnames(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rows, err := db.Query("SELECT id, website_id, hostname, created_at FROM website_hostnames WHERE website_id = $1 ORDER BY hostname", websiteID)
+		if err != nil {
+			log.Println("Error querying website hostnames:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		defer rows.Close()
+
+		hostnames := []models.WebsiteHostname{}
+		for rows.Next() {
+			var hostname models.WebsiteHostname
+			if err := rows.Scan(&hostname.ID, &hostname.WebsiteID, &hostname.Hostname, &hostname.CreatedAt); err != nil {
+				log.Println("Error scanning website hostname:", err)
+				utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+				return
+			}
+			hostnames = append(hostnames, hostname)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating website hostnames:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(hostnames)
+	}
+}
+
+// AddWebsiteHostname lets a website accept hits from an extra hostname (or from every subdomain with a *. wildcard) besides its registered domain and its www. counterpart
+func AddWebsiteHostname(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var hostnameReceiver models.WebsiteHostnameReceiver
+		if err := json.NewDecoder(r.Body).Decode(&hostnameReceiver); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		hostnameReceiver.Hostname = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostnameReceiver.Hostname)), ".")
+		if err := hostnameReceiver.ValidateHostname(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// Only admins can add hostnames outside of the registered domain of the website
+		if role, _ := r.Context().Value(middleware.RoleKey).(string); role != "admin" {
+			if err := hostnameReceiver.ValidateOwnership(domain); err != nil {
+				utils.WriteErrorResponse(w, http.StatusForbidden, err)
+				return
+			}
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		// A hostname can only point to one website, and a registered domain always belongs to its own website
+		var exists bool
+		err = db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM websites WHERE domain = $1)
+				OR EXISTS(SELECT 1 FROM website_hostnames WHERE hostname = $1)
+		`, hostnameReceiver.Hostname).Scan(&exists)
+		if err != nil {
+			log.Println("Error checking for existing hostname:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if exists {
+			utils.WriteErrorResponse(w, http.StatusConflict, errors.New("hostname already exists"))
+			return
+		}
+
+		hostname := models.WebsiteHostname{
+			WebsiteID: websiteID,
+			Hostname:  hostnameReceiver.Hostname,
+		}
+		err = db.QueryRow(
+			"INSERT INTO website_hostnames (website_id, hostname) VALUES ($1, $2) RETURNING id, created_at",
+			hostname.WebsiteID, hostname.Hostname,
+		).Scan(&hostname.ID, &hostname.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting website hostname:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hostname)
+	}
+}
+
+func DeleteWebsiteHostname(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		hostname, err := utils.ExtractHostnameFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM website_hostnames
+			USING websites
+			WHERE websites.id = website_hostnames.website_id AND websites.domain = $1 AND website_hostnames.hostname = $2
+		`, domain, strings.ToLower(hostname))
+		if err != nil {
+			log.Println("Error deleting website hostname:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("hostname %s not found for website %s", hostname, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"hostname": hostname,
+			"message":  "Hostname deleted successfully",
+		})
+	}
+}
+
+func GetIngestKeys(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rows, err := db.Query(`
+			SELECT id, website_id, name, key_prefix, created_at, last_used_at, revoked_at
+			FROM ingest_keys
+			WHERE website_id = $1
+			ORDER BY created_at DESC
+		`, websiteID)
+		if err != nil {
+			log.Println("Error querying ingest keys:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		defer rows.Close()
+
+		ingestKeys := []models.IngestKey{}
+		for rows.Next() {
+			var ingestKey models.IngestKey
+			if err := rows.Scan(&ingestKey.ID, &ingestKey.WebsiteID, &ingestKey.Name, &ingestKey.Prefix, &ingestKey.CreatedAt, &ingestKey.LastUsedAt, &ingestKey.RevokedAt); err != nil {
+				log.Println("Error scanning ingest key:", err)
+				utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+				return
+			}
+			ingestKeys = append(ingestKeys, ingestKey)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating ingest keys:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ingestKeys)
+	}
+}
+
+// CreateIngestKey creates a key for sending server-side visits and events. The key is only part of this response, afterwards just its prefix can be retrieved.
+func CreateIngestKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var ingestKeyReceiver models.IngestKeyReceiver
+		if err := json.NewDecoder(r.Body).Decode(&ingestKeyReceiver); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		ingestKeyReceiver.Name = strings.TrimSpace(ingestKeyReceiver.Name)
+		if err := ingestKeyReceiver.ValidateIngestKey(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		key, keyHash, keyPrefix, err := services.GenerateIngestKey()
+		if err != nil {
+			log.Println("Error generating ingest key:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		ingestKey := models.IngestKeyCreated{
+			IngestKey: models.IngestKey{
+				WebsiteID: websiteID,
+				Name:      ingestKeyReceiver.Name,
+				Prefix:    keyPrefix,
+			},
+			Key: key,
+		}
+		err = db.QueryRow(
+			"INSERT INTO ingest_keys (website_id, name, key_hash, key_prefix) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+			websiteID, ingestKeyReceiver.Name, keyHash, keyPrefix,
+		).Scan(&ingestKey.ID, &ingestKey.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting ingest key:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ingestKey)
+	}
+}
+
+// RevokeIngestKey disables a key. Revoked keys are kept so that the list shows when they were last used.
+func RevokeIngestKey(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		keyID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			UPDATE ingest_keys
+			SET revoked_at = NOW()
+			FROM websites
+			WHERE websites.id = ingest_keys.website_id AND websites.domain = $1 AND ingest_keys.id = $2 AND ingest_keys.revoked_at IS NULL
+		`, domain, keyID)
+		if err != nil {
+			log.Println("Error revoking ingest key:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("active ingest key %d not found for website %s", keyID, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Ingest key revoked successfully",
+		})
+	}
+}
+
+func GetReferrerRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rows, err := db.Query("SELECT id, website_id, rule_type, pattern, created_at FROM referrer_block_rules WHERE website_id = $1 ORDER BY id", websiteID)
+		if err != nil {
+			log.Println("Error querying referrer rules:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		defer rows.Close()
+
+		rules := []models.ReferrerRule{}
+		for rows.Next() {
+			var rule models.ReferrerRule
+			if err := rows.Scan(&rule.ID, &rule.WebsiteID, &rule.Type, &rule.Pattern, &rule.CreatedAt); err != nil {
+				log.Println("Error scanning referrer rule:", err)
+				utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+				return
+			}
+			rules = append(rules, rule)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating referrer rules:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rules)
+	}
+}
+
+// CreateReferrerRule adds a rule discarding the visits and events of a website coming from a spam referrer, on top of the bundled referrer spam list
+func CreateReferrerRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var ruleReceiver models.ReferrerRuleReceiver
+		if err := json.NewDecoder(r.Body).Decode(&ruleReceiver); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		ruleReceiver.Type = strings.ToLower(strings.TrimSpace(ruleReceiver.Type))
+		ruleReceiver.Pattern = strings.TrimSpace(ruleReceiver.Pattern)
+		if ruleReceiver.Type != models.ReferrerRuleRegex {
+			ruleReceiver.Pattern = strings.ToLower(ruleReceiver.Pattern)
+		}
+		if err := ruleReceiver.ValidateReferrerRule(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rule := models.ReferrerRule{
+			WebsiteID: websiteID,
+			Type:      ruleReceiver.Type,
+			Pattern:   ruleReceiver.Pattern,
+		}
+		err = db.QueryRow(
+			"INSERT INTO referrer_block_rules (website_id, rule_type, pattern) VALUES ($1, $2, $3) RETURNING id, created_at",
+			rule.WebsiteID, rule.Type, rule.Pattern,
+		).Scan(&rule.ID, &rule.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting referrer rule:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	}
+}
+
+func DeleteReferrerRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		ruleID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM referrer_block_rules
+			USING websites
+			WHERE websites.id = referrer_block_rules.website_id AND websites.domain = $1 AND referrer_block_rules.id = $2
+		`, domain, ruleID)
+		if err != nil {
+			log.Println("Error deleting referrer rule:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("referrer rule %d not found for website %s", ruleID, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Referrer rule deleted successfully",
+		})
+	}
+}
+
+func GetPathnameRewrites(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rows, err := db.Query("SELECT id, website_id, position, pattern, replacement, created_at FROM pathname_rewrite_rules WHERE website_id = $1 ORDER BY position, id", websiteID)
+		if err != nil {
+			log.Println("Error querying pathname rewrites:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		defer rows.Close()
+
+		rewrites := []models.PathnameRewrite{}
+		for rows.Next() {
+			var rewrite models.PathnameRewrite
+			if err := rows.Scan(&rewrite.ID, &rewrite.WebsiteID, &rewrite.Position, &rewrite.Pattern, &rewrite.Replacement, &rewrite.CreatedAt); err != nil {
+				log.Println("Error scanning pathname rewrite:", err)
+				utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+				return
+			}
+			rewrites = append(rewrites, rewrite)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating pathname rewrites:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rewrites)
+	}
+}
+
+// CreatePathnameRewrite adds a regex rewrite applied to the pathnames of the website before they are stored. It only affects new visits and events until the rules are reapplied.
+func CreatePathnameRewrite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var rewriteReceiver models.PathnameRewriteReceiver
+		if err := json.NewDecoder(r.Body).Decode(&rewriteReceiver); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		rewriteReceiver.Pattern = strings.TrimSpace(rewriteReceiver.Pattern)
+		if err := rewriteReceiver.ValidatePathnameRewrite(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rewrite := models.PathnameRewrite{
+			WebsiteID:   websiteID,
+			Pattern:     rewriteReceiver.Pattern,
+			Replacement: rewriteReceiver.Replacement,
+		}
+		// Without a position the rewrite runs after the existing ones
+		err = db.QueryRow(`
+			INSERT INTO pathname_rewrite_rules (website_id, position, pattern, replacement)
+			VALUES ($1, COALESCE($2, (SELECT COALESCE(MAX(position), 0) + 1 FROM pathname_rewrite_rules WHERE website_id = $1)), $3, $4)
+			RETURNING id, position, created_at
+		`, rewrite.WebsiteID, rewriteReceiver.Position, rewrite.Pattern, rewrite.Replacement).Scan(&rewrite.ID, &rewrite.Position, &rewrite.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting pathname rewrite:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rewrite)
+	}
+}
+
+func DeletePathnameRewrite(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		rewriteID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM pathname_rewrite_rules
+			USING websites
+			WHERE websites.id = pathname_rewrite_rules.website_id AND websites.domain = $1 AND pathname_rewrite_rules.id = $2
+		`, domain, rewriteID)
+		if err != nil {
+			log.Println("Error deleting pathname rewrite:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("pathname rewrite %d not found for website %s", rewriteID, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Pathname rewrite deleted successfully",
+		})
+	}
+}
+
+// ApplyPathnameRules rewrites the pathnames already stored for the website with its current pathname settings and rewrites
+func ApplyPathnameRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := getWebsiteID(db, domain); err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		result, err := services.ReapplyPathnameRules(db, domain)
+		if err != nil {
+			log.Println("Error reapplying pathname rules:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func GetExclusionRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rows, err := db.Query("SELECT id, website_id, rule_type, pattern, created_at FROM exclusion_rules WHERE website_id = $1 ORDER BY id", websiteID)
+		if err != nil {
+			log.Println("Error querying exclusion rules:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		defer rows.Close()
+
+		rules := []models.ExclusionRule{}
+		for rows.Next() {
+			var rule models.ExclusionRule
+			if err := rows.Scan(&rule.ID, &rule.WebsiteID, &rule.Type, &rule.Pattern, &rule.CreatedAt); err != nil {
+				log.Println("Error scanning exclusion rule:", err)
+				utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+				return
+			}
+			rules = append(rules, rule)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("Error iterating exclusion rules:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(rules)
+	}
+}
+
+// CreateExclusionRule adds a rule discarding the visits and events of a website coming from an ip range, sent from a hostname or viewing a pathname (e.g. office ips, a staging alias, admin pages). Hostname rules only apply to the hostnames the website accepts, its domain and aliases.
+func CreateExclusionRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var ruleReceiver models.ExclusionRuleReceiver
+		if err := json.NewDecoder(r.Body).Decode(&ruleReceiver); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+
+		ruleReceiver.Normalize()
+		if err := ruleReceiver.ValidateExclusionRule(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		websiteID, err := getWebsiteID(db, domain)
+		if err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rule := models.ExclusionRule{
+			WebsiteID: websiteID,
+			Type:      ruleReceiver.Type,
+			Pattern:   ruleReceiver.Pattern,
+		}
+		err = db.QueryRow(
+			"INSERT INTO exclusion_rules (website_id, rule_type, pattern) VALUES ($1, $2, $3) RETURNING id, created_at",
+			rule.WebsiteID, rule.Type, rule.Pattern,
+		).Scan(&rule.ID, &rule.CreatedAt)
+		if err != nil {
+			log.Println("Error inserting exclusion rule:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	}
+}
+
+func DeleteExclusionRule(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		ruleID, err := utils.ExtractIDFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		result, err := db.Exec(`
+			DELETE FROM exclusion_rules
+			USING websites
+			WHERE websites.id = exclusion_rules.website_id AND websites.domain = $1 AND exclusion_rules.id = $2
+		`, domain, ruleID)
+		if err != nil {
+			log.Println("Error deleting exclusion rule:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+		if rowsAffected == 0 {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("exclusion rule %d not found for website %s", ruleID, domain))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Exclusion rule deleted successfully",
+		})
+	}
+}
+
+// TestExclusionRules is a dry run of the exclusion rules of a website: it reports which rule, if any, would discard a sample request with the given ip and page url
+func TestExclusionRules(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		domain, err := utils.ExtractDomainFromURL(r)
+		if err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var sample models.ExclusionTestReceiver
+		if err := json.NewDecoder(r.Body).Decode(&sample); err != nil {
+			log.Println("Error decoding JSON:", err)
+			utils.WriteErrorResponse(w, http.StatusBadRequest, errors.New("invalid request format"))
+			return
+		}
+		sample.IP = strings.TrimSpace(sample.IP)
+		sample.URL = strings.TrimSpace(sample.URL)
+		if err := sample.ValidateExclusionTest(); err != nil {
+			utils.WriteErrorResponse(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if _, err := getWebsiteID(db, domain); err == sql.ErrNoRows {
+			utils.WriteErrorResponse(w, http.StatusNotFound, fmt.Errorf("website with domain %s doesn't exist", domain))
+			return
+		} else if err != nil {
+			log.Println("Error querying website:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		result, err := services.TestExclusionRules(db, domain, sample)
+		if err != nil {
+			log.Println("Error testing exclusion rules:", err)
+			utils.WriteErrorResponse(w, http.StatusInternalServerError, errors.New("internal server error"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func getWebsiteID(db *sql.DB, domain string) (int, error) {
+	var websiteID int
+	err := db.QueryRow("SELECT id FROM websites WHERE domain = $1", domain).Scan(&websiteID)
+	return websiteID, err
+}
+
 // // todo fix this. IT DOESN'T WORK CORRECTLY AT THE MOMENT
 // // UpdateWebsite updates an existing website in the database
 // func UpdateWebsite(db *sql.DB) http.HandlerFunc {
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/mvavassori/flockcounter/db"
+	"github.com/mvavassori/flockcounter/middleware"
+	"github.com/mvavassori/flockcounter/services"
+	"github.com/mvavassori/flockcounter/utils"
 )
 
 func main() {
@@ -18,35 +26,117 @@ func main() {
 	}
 	defer postgresDB.Close()
 
-	// Connect to GeoIP
-	geoipDB, err := db.CreateGeoIPConnection()
+	// Geolocation provider, a GeoIP database unless configured otherwise
+	geolocator, err := db.CreateGeolocator()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer geoipDB.Close()
+
+	// Optional ASN database recording the network of the visitors
+	asnDB, err := db.CreateASNDatabase()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// GeoIP databases are reloaded when their file changes and on SIGHUP, keeping the current one if the new file is invalid
+	var geoipDBs []*utils.GeoIPDatabase
+	if geoipDB, ok := geolocator.(*utils.GeoIPDatabase); ok {
+		geoipDBs = append(geoipDBs, geoipDB)
+	}
+	if asnDB != nil {
+		geoipDBs = append(geoipDBs, asnDB)
+	}
+	if len(geoipDBs) > 0 {
+		reloadInterval := utils.GeoIPReloadIntervalFromEnv()
+		for _, geoipDB := range geoipDBs {
+			defer geoipDB.Close()
+			go geoipDB.Watch(reloadInterval)
+		}
+
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+		go func() {
+			for range reloadSignals {
+				for _, geoipDB := range geoipDBs {
+					if err := geoipDB.Reload(); err != nil {
+						log.Printf("Error reloading GeoIP database %s, keeping the current one: %v", geoipDB.Path(), err)
+					}
+				}
+			}
+		}()
+	}
+
+	// Referrer spam list, the bundled one is used unless a file is configured
+	if path := os.Getenv("REFERRER_SPAM_LIST_PATH"); path != "" {
+		count, err := utils.LoadReferrerSpamList(path)
+		if err != nil {
+			log.Fatalf("Error loading referrer spam list: %v", err)
+		}
+		log.Printf("Loaded %d referrer spam domains from %s", count, path)
+	}
+
+	// Proxies allowed to set the client ip through forwarding headers, the private networks are trusted unless a list is configured
+	if list := os.Getenv("TRUSTED_PROXIES"); list != "" {
+		count, err := utils.LoadTrustedProxies(list)
+		if err != nil {
+			log.Fatalf("Error loading trusted proxies: %v", err)
+		}
+		log.Printf("Trusting forwarding headers from %d proxy ranges", count)
+	}
+
+	// Inactivity timeout splitting the pageviews of a visitor into sessions
+	services.SetSessionTimeout(services.SessionTimeoutFromEnv())
+
+	// Asynchronous ingest queue, visits and events are written synchronously unless it's enabled
+	var ingestQueue *services.IngestQueue
+	if os.Getenv("INGEST_ASYNC") == "true" {
+		ingestQueue = services.NewIngestQueue(postgresDB, services.IngestQueueConfigFromEnv())
+		ingestQueue.Start()
+	}
+
+	// Rate limits of the public endpoints
+	rateLimits := middleware.NewRateLimits(postgresDB, middleware.RateLimitConfigFromEnv())
 
 	// router
-	router := SetupRouter(postgresDB, geoipDB)
+	router := SetupRouter(postgresDB, geolocator, asnDB, ingestQueue, rateLimits)
 
 	port := 8080
 	address := fmt.Sprintf(":%d", port) // :8080
 
-	log.Printf("Server is listening on port %d...\n", port)
-
+	server := &http.Server{Addr: address}
 	if os.Getenv("ENV") == "development" {
-		err = http.ListenAndServe(address, handlers.CORS( // cors config for development
+		server.Handler = handlers.CORS( // cors config for development
 			handlers.AllowedOrigins([]string{"*"}),
 			handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"}),
 			handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}),
-		)(router))
+		)(router)
 	} else {
-		err = http.ListenAndServe(address, router) // nginx will handle cors
+		server.Handler = router // nginx will handle cors
 	}
 
-	if err != nil {
-		log.Fatalf("Failed to start server: %v\n", err)
+	go func() {
+		log.Printf("Server is listening on port %d...\n", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v\n", err)
+		}
+	}()
+
+	// Wait for a termination signal and shut down gracefully
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v\n", err)
 	}
 
+	// Flush the visits and events still in the queue once no handler can enqueue anymore
+	if ingestQueue != nil {
+		ingestQueue.Close()
+	}
 }
 
 // Explanation to novices:
@@ -16,6 +16,7 @@ type contextKey string
 
 const UserIdKey contextKey = "userId"
 const RoleKey contextKey = "role"
+const IngestKeyAuthKey contextKey = "ingestKeyAuth"
 
 var demoDomain string
 
@@ -147,6 +148,15 @@ func AdminOrOwner(next http.Handler) http.Handler {
 
 // check for website domain
 func AdminOrUserWebsite(db *sql.DB) func(http.Handler) http.Handler {
+	return websiteAccess(db, true)
+}
+
+// AdminOrWebsiteOwner is like AdminOrUserWebsite but doesn't open GET requests on the demo domain to everyone. Use it for routes exposing secrets (e.g. ingest keys).
+func AdminOrWebsiteOwner(db *sql.DB) func(http.Handler) http.Handler {
+	return websiteAccess(db, false)
+}
+
+func websiteAccess(db *sql.DB, publicDemoReads bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			urlWebsiteDomain, err := utils.ExtractDomainFromURL(r)
@@ -156,7 +166,7 @@ func AdminOrUserWebsite(db *sql.DB) func(http.Handler) http.Handler {
 			}
 
 			// For the demo domain, only allow GET requests without token checks.
-			if urlWebsiteDomain == demoDomain && r.Method == "GET" {
+			if publicDemoReads && urlWebsiteDomain == demoDomain && r.Method == "GET" {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -241,8 +251,11 @@ func AdminOrUserWebsite(db *sql.DB) func(http.Handler) http.Handler {
 				return
 			}
 
+			// Add the role to context, some handlers allow admins more
+			ctx := context.WithValue(r.Context(), RoleKey, role)
+
 			// Proceed to the next handler
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
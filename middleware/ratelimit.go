@@ -0,0 +1,426 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mvavassori/flockcounter/services"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+// Rate is a token bucket holding Requests tokens and refilled at Requests per Per. A zero Rate means no limit.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (r Rate) Enabled() bool {
+	return r.Requests > 0 && r.Per > 0
+}
+
+// tokens refilled per second
+func (r Rate) refill() float64 {
+	return float64(r.Requests) / r.Per.Seconds()
+}
+
+// ParseRate parses rates like "300/m", "10/h" or "5/s". "0" (or an empty string) disables the limit.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Rate{}, nil
+	}
+
+	count, unit, ok := strings.Cut(s, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected something like 300/m", s)
+	}
+
+	requests, err := strconv.Atoi(count)
+	if err != nil || requests < 0 {
+		return Rate{}, fmt.Errorf("invalid request count in rate %q", s)
+	}
+
+	// Buckets are forgotten after bucketIdleTTL, so no unit can be longer than that
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Rate{}, fmt.Errorf("invalid unit in rate %q, use s, m or h", s)
+	}
+
+	return Rate{Requests: requests, Per: per}, nil
+}
+
+// A bucket untouched for this long is full again whatever its rate, so it can be dropped
+const bucketIdleTTL = time.Hour
+
+// RateLimiter takes cost tokens from the bucket identified by key. A request is let through as long as the bucket holds a whole token, a cost bigger than that (e.g. a batch) leaves the bucket in debt until it refills. When the bucket is empty it returns false and how long to wait for the next token.
+type RateLimiter interface {
+	Allow(key string, rate Rate, cost int) (bool, time.Duration, error)
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryRateLimiter keeps the buckets in the process memory, limits are per replica
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	limiter := &MemoryRateLimiter{buckets: make(map[string]*tokenBucket)}
+	go limiter.cleanup()
+	return limiter
+}
+
+func (l *MemoryRateLimiter) Allow(key string, rate Rate, cost int) (bool, time.Duration, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(rate.Requests), updatedAt: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(rate.Requests), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rate.refill())
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, retryAfter(bucket.tokens, rate), nil
+	}
+	bucket.tokens -= float64(cost)
+	return true, 0, nil
+}
+
+func (l *MemoryRateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if time.Since(bucket.updatedAt) > bucketIdleTTL {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// PostgresRateLimiter keeps the buckets in the rate_limit_buckets table so that limits hold across multiple backend replicas
+type PostgresRateLimiter struct {
+	db *sql.DB
+}
+
+func NewPostgresRateLimiter(db *sql.DB) *PostgresRateLimiter {
+	limiter := &PostgresRateLimiter{db: db}
+	go limiter.cleanup()
+	return limiter
+}
+
+func (l *PostgresRateLimiter) Allow(key string, rate Rate, cost int) (bool, time.Duration, error) {
+	// The refill and the take happen in a single statement, the row lock taken by the upsert serializes concurrent requests on the same bucket
+	query := `
+		INSERT INTO rate_limit_buckets AS bucket (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::double precision - $4::double precision, true, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE
+				WHEN LEAST($2::double precision, bucket.tokens + EXTRACT(EPOCH FROM NOW() - bucket.updated_at)::double precision * $3::double precision) >= 1
+				THEN LEAST($2::double precision, bucket.tokens + EXTRACT(EPOCH FROM NOW() - bucket.updated_at)::double precision * $3::double precision) - $4::double precision
+				ELSE LEAST($2::double precision, bucket.tokens + EXTRACT(EPOCH FROM NOW() - bucket.updated_at)::double precision * $3::double precision)
+			END,
+			allowed = LEAST($2::double precision, bucket.tokens + EXTRACT(EPOCH FROM NOW() - bucket.updated_at)::double precision * $3::double precision) >= 1,
+			updated_at = NOW()
+		RETURNING tokens, allowed
+	`
+
+	var tokens float64
+	var allowed bool
+	err := l.db.QueryRow(query, key, float64(rate.Requests), rate.refill(), float64(cost)).Scan(&tokens, &allowed)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !allowed {
+		return false, retryAfter(tokens, rate), nil
+	}
+	return true, 0, nil
+}
+
+func (l *PostgresRateLimiter) cleanup() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, err := l.db.Exec("DELETE FROM rate_limit_buckets WHERE updated_at < NOW() - make_interval(secs => $1::double precision)", bucketIdleTTL.Seconds())
+		if err != nil {
+			log.Println("Error deleting idle rate limit buckets:", err)
+		}
+	}
+}
+
+// retryAfter returns how long it takes for the bucket to hold a whole token again
+func retryAfter(tokens float64, rate Rate) time.Duration {
+	return time.Duration((1 - tokens) / rate.refill() * float64(time.Second))
+}
+
+type RateLimitConfig struct {
+	Enabled       bool
+	Store         string // "memory" (default) or "postgres"
+	IngestIP      Rate   // visits and events sent by browsers, per client IP
+	IngestKey     Rate   // visits and events sent with a valid ingest key, per key
+	IngestWebsite Rate   // visits and events, per target website (aliases included), batches count each item
+	SignupIP      Rate
+	LoginIP       Rate
+}
+
+// RateLimitConfigFromEnv reads the RATE_LIMIT_* environment variables, falling back to defaults that a regular visitor (or a NATed office) won't hit
+func RateLimitConfigFromEnv() RateLimitConfig {
+	config := RateLimitConfig{
+		Enabled:   os.Getenv("RATE_LIMIT_ENABLED") != "false",
+		Store:     "memory",
+		IngestIP:  Rate{Requests: 300, Per: time.Minute},
+		IngestKey: Rate{Requests: 6000, Per: time.Minute},
+		SignupIP:  Rate{Requests: 10, Per: time.Hour},
+		LoginIP:   Rate{Requests: 10, Per: time.Minute},
+	}
+
+	if store := os.Getenv("RATE_LIMIT_STORE"); store != "" {
+		config.Store = store
+	}
+
+	rates := map[string]*Rate{
+		"RATE_LIMIT_INGEST_IP":      &config.IngestIP,
+		"RATE_LIMIT_INGEST_KEY":     &config.IngestKey,
+		"RATE_LIMIT_INGEST_WEBSITE": &config.IngestWebsite,
+		"RATE_LIMIT_SIGNUP_IP":      &config.SignupIP,
+		"RATE_LIMIT_LOGIN_IP":       &config.LoginIP,
+	}
+	for env, rate := range rates {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		parsed, err := ParseRate(value)
+		if err != nil {
+			log.Printf("Ignoring %s: %v", env, err)
+			continue
+		}
+		*rate = parsed
+	}
+
+	return config
+}
+
+// RateLimits holds the limiter and the limits of each route group
+type RateLimits struct {
+	db      *sql.DB // authenticates ingest keys
+	limiter RateLimiter
+	config  RateLimitConfig
+}
+
+func NewRateLimits(db *sql.DB, config RateLimitConfig) *RateLimits {
+	var limiter RateLimiter
+	if config.Store == "postgres" {
+		limiter = NewPostgresRateLimiter(db)
+	} else {
+		limiter = NewMemoryRateLimiter()
+	}
+	return &RateLimits{db: db, limiter: limiter, config: config}
+}
+
+// IngestKeyAuth is the outcome of authenticating the ingest key of a request, the Ingest middleware stores it in the request context under IngestKeyAuthKey so that the handler doesn't query the key again
+type IngestKeyAuth struct {
+	WebsiteID int
+	Err       error // ErrInvalidIngestKey for unknown or revoked keys
+}
+
+// Ingest limits the visit and event endpoints per client IP and per target website, a batch taking a token of its website for each item. Requests carrying a valid ingest key come from backends sending the traffic of many visitors, so they get their own, higher, limit per key instead. An invalid key gets the per IP limit of the browsers, so that making up keys doesn't lift it.
+func (rl *RateLimits) Ingest(next http.Handler) http.Handler {
+	if rl == nil {
+		return next
+	}
+
+	limited := rl.limit(next, func(r *http.Request) []rateLimitRule {
+		callerRule := rateLimitRule{key: "ingest:ip:" + utils.GetIPAddress(r), rate: rl.config.IngestIP, cost: 1}
+		if auth, ok := r.Context().Value(IngestKeyAuthKey).(IngestKeyAuth); ok && auth.Err == nil {
+			callerRule = rateLimitRule{key: "ingest-key:" + services.HashIngestKey(r.Header.Get("X-Ingest-Key")), rate: rl.config.IngestKey, cost: 1}
+		}
+
+		rules := []rateLimitRule{callerRule}
+		if rl.config.IngestWebsite.Enabled() {
+			for websiteID, items := range rl.payloadWebsites(r) {
+				rules = append(rules, rateLimitRule{key: "ingest:website:" + strconv.Itoa(websiteID), rate: rl.config.IngestWebsite, cost: items})
+			}
+		}
+		return rules
+	})
+
+	// The key is authenticated even when rate limiting is disabled, the handler needs the result either way
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-Ingest-Key"); key != "" {
+			var auth IngestKeyAuth
+			auth.WebsiteID, auth.Err = services.AuthenticateIngestKey(rl.db, key)
+			if auth.Err != nil && auth.Err != services.ErrInvalidIngestKey {
+				log.Println("Error authenticating ingest key:", auth.Err)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), IngestKeyAuthKey, auth))
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+func (rl *RateLimits) Signup(next http.Handler) http.Handler {
+	return rl.limit(next, func(r *http.Request) []rateLimitRule {
+		return []rateLimitRule{{key: "signup:ip:" + utils.GetIPAddress(r), rate: rl.config.SignupIP, cost: 1}}
+	})
+}
+
+func (rl *RateLimits) Login(next http.Handler) http.Handler {
+	return rl.limit(next, func(r *http.Request) []rateLimitRule {
+		return []rateLimitRule{{key: "login:ip:" + utils.GetIPAddress(r), rate: rl.config.LoginIP, cost: 1}}
+	})
+}
+
+type rateLimitRule struct {
+	key  string
+	rate Rate
+	cost int // tokens taken from the bucket
+}
+
+func (rl *RateLimits) limit(next http.Handler, rules func(r *http.Request) []rateLimitRule) http.Handler {
+	if rl == nil || !rl.config.Enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range rules(r) {
+			if !rule.rate.Enabled() {
+				continue
+			}
+
+			allowed, wait, err := rl.limiter.Allow(rule.key, rule.rate, rule.cost)
+			if err != nil {
+				// Fail open, an unavailable limiter store shouldn't take the public endpoints down with it
+				log.Println("Error checking rate limit:", err)
+				continue
+			}
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Batches are capped at 5 MB by the handlers, a bigger body is rejected anyway
+const maxPeekBytes = 5 << 20
+
+// payloadWebsites returns the number of hits the request carries for each website. Requests with a valid ingest key can only store hits of the website of the key, the hostnames of browser hits are matched to their website like the ingest pipeline does, so that the aliases of a website share its bucket. Hits of unregistered hostnames are left out, they are dropped by the handler.
+func (rl *RateLimits) payloadWebsites(r *http.Request) map[int]int {
+	hostnames := peekPayloadHostnames(r)
+	websites := make(map[int]int)
+
+	if auth, ok := r.Context().Value(IngestKeyAuthKey).(IngestKeyAuth); ok && auth.Err == nil {
+		for _, items := range hostnames {
+			websites[auth.WebsiteID] += items
+		}
+		return websites
+	}
+
+	for hostname, items := range hostnames {
+		websiteID, err := services.WebsiteIDForHostname(rl.db, hostname)
+		if err != nil {
+			if err != services.ErrUnregisteredDomain {
+				log.Println("Error looking up website for rate limiting:", err)
+			}
+			continue
+		}
+		websites[websiteID] += items
+	}
+	return websites
+}
+
+// peekPayloadHostnames returns the hostnames of the url field of a single visit or event payload, or of the items of a batch (a JSON array or newline delimited JSON), with how many hits each of them has. It puts the body back for the handler, and returns nil for payloads it can't read.
+func peekPayloadHostnames(r *http.Request) map[string]int {
+	if r.Body == nil {
+		return nil
+	}
+
+	peeked, err := io.ReadAll(io.LimitReader(r.Body, maxPeekBytes))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), r.Body), r.Body}
+	if err != nil {
+		return nil
+	}
+
+	type payload struct {
+		URL string `json:"url"`
+	}
+
+	// A single payload is a batch of one, NDJSON is read one value at a time
+	var payloads []payload
+	decoder := json.NewDecoder(bytes.NewReader(peeked))
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil
+		}
+
+		if bytes.HasPrefix(raw, []byte("[")) {
+			var items []payload
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil
+			}
+			payloads = append(payloads, items...)
+			continue
+		}
+
+		var item payload
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil
+		}
+		payloads = append(payloads, item)
+	}
+
+	hostnames := make(map[string]int)
+	for _, item := range payloads {
+		pageURL, err := url.Parse(item.URL)
+		if err != nil || pageURL.Hostname() == "" {
+			continue
+		}
+		hostnames[pageURL.Hostname()]++
+	}
+	return hostnames
+}
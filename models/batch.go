@@ -0,0 +1,24 @@
+package models
+
+const (
+	BatchItemAccepted = "accepted"
+	BatchItemRejected = "rejected"
+)
+
+// BatchItemResult reports what happened to a single item of a batch ingestion request
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"` // "accepted" or "rejected"
+	Error  string `json:"error,omitempty"`
+}
+
+func (b *BatchItemResult) Reject(reason string) {
+	b.Status = BatchItemRejected
+	b.Error = reason
+}
+
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 type Event struct {
 	ID            int64     `json:"id"`
@@ -19,37 +23,53 @@ type Event struct {
 	Country       string    `json:"country"`
 	Region        string    `json:"region"`
 	City          string    `json:"city"`
+	CountryCode   string    `json:"countryCode"` // ISO 3166-1 alpha-2
+	RegionCode    string    `json:"regionCode"`  // ISO 3166-2
+	Continent     string    `json:"continent"`   // continent code
 	IsUnique      bool      `json:"isUnique"`
 }
 
 type EventReceiver struct {
-	Type      string    `json:"type"`
-	Name      string    `json:"name"`
-	Timestamp time.Time `json:"timestamp"`
-	Referrer  string    `json:"referrer"`
-	URL       string    `json:"url"`
-	Pathname  string    `json:"pathname"`
-	UserAgent string    `json:"userAgent"`
-	Language  string    `json:"language"`
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Referrer   string            `json:"referrer"`
+	URL        string            `json:"url"`
+	Pathname   string            `json:"pathname"`
+	UserAgent  string            `json:"userAgent"`
+	Language   string            `json:"language"`
+	IP         string            `json:"ip"` // visitor IP, only honoured for server-side events sent with an ingest key
+	Properties map[string]string `json:"properties"`
 }
 
 type EventInsert struct {
-	WebsiteID     int64     `json:"websiteId"`
-	WebsiteDomain string    `json:"websiteDomain"`
-	Type          string    `json:"type"`
-	Name          string    `json:"name"`
-	Timestamp     time.Time `json:"timestamp"`
-	Referrer      string    `json:"referrer"`
-	URL           string    `json:"url"`
-	Pathname      string    `json:"pathname"`
-	DeviceType    string    `json:"deviceType"`
-	OS            string    `json:"os"`
-	Browser       string    `json:"browser"`
-	Language      string    `json:"language"`
-	Country       string    `json:"country"`
-	Region        string    `json:"region"`
-	City          string    `json:"city"`
-	IsUnique      bool      `json:"isUnique"`
+	WebsiteID     int64             `json:"websiteId"`
+	WebsiteDomain string            `json:"websiteDomain"`
+	Type          string            `json:"type"`
+	Name          string            `json:"name"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Referrer      string            `json:"referrer"`
+	URL           string            `json:"url"`
+	Pathname      string            `json:"pathname"`
+	DeviceType    string            `json:"deviceType"`
+	OS            string            `json:"os"`
+	Browser       string            `json:"browser"`
+	Language      string            `json:"language"`
+	Country       string            `json:"country"`
+	Region        string            `json:"region"`
+	City          string            `json:"city"`
+	CountryCode   string            `json:"countryCode"`
+	RegionCode    string            `json:"regionCode"`
+	Continent     string            `json:"continent"`
+	CountryID     uint              `json:"countryId"` // GeoNames IDs, 0 if unknown
+	RegionID      uint              `json:"regionId"`
+	CityID        uint              `json:"cityId"`
+	ASN           uint              `json:"asn"` // 0 without an ASN database
+	ASNOrg        string            `json:"asnOrg"`
+	IsDatacenter  bool              `json:"isDatacenter"`
+	IsUnique      bool              `json:"isUnique"`
+	VisitorID     string            `json:"-"` // daily hashed visitor identifier, never exposed
+	Properties    map[string]string `json:"properties"`
 }
 
 type EventUpdateResponse struct {
@@ -59,3 +79,28 @@ type EventUpdateResponse struct {
 	WebsiteDomain string    `json:"websiteDomain"`
 	Timestamp     time.Time `json:"timestamp"`
 }
+
+// Limits on the custom properties of an event
+const (
+	MaxEventProperties       = 30
+	MaxEventPropertyKeyLen   = 100
+	MaxEventPropertyValueLen = 500
+)
+
+func (e *EventReceiver) ValidateProperties() error {
+	if len(e.Properties) > MaxEventProperties {
+		return fmt.Errorf("an event can have at most %d properties", MaxEventProperties)
+	}
+	for key, value := range e.Properties {
+		if key == "" {
+			return errors.New("property keys cannot be empty")
+		}
+		if len(key) > MaxEventPropertyKeyLen {
+			return fmt.Errorf("property keys must be at most %d characters long", MaxEventPropertyKeyLen)
+		}
+		if len(value) > MaxEventPropertyValueLen {
+			return fmt.Errorf("property %s must be at most %d characters long", key, MaxEventPropertyValueLen)
+		}
+	}
+	return nil
+}
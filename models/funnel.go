@@ -0,0 +1,103 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Limits on the definition of a funnel. The visitor identifier rotates every day, so steps can't be linked over more than a day anyway.
+const (
+	MinFunnelSteps         = 2
+	MaxFunnelSteps         = 8
+	DefaultFunnelWindowMin = 60
+	MaxFunnelWindowMin     = 24 * 60
+)
+
+// FunnelStep is a pageview of a pathname pattern or an event name, using the same types as goals
+type FunnelStep struct {
+	Type      string `json:"type"`
+	Pathname  string `json:"pathname,omitempty"`
+	EventName string `json:"eventName,omitempty"`
+}
+
+// PathnameLikePattern turns the pathname pattern of a pageview step into a LIKE pattern
+func (s *FunnelStep) PathnameLikePattern() string {
+	return pathnameLikePattern(s.Pathname)
+}
+
+// Label returns the pathname or the event name of the step
+func (s *FunnelStep) Label() string {
+	if s.Type == GoalTypePageview {
+		return s.Pathname
+	}
+	return s.EventName
+}
+
+// Funnel is an ordered list of steps a visitor has to go through within WindowMinutes of the first one
+type Funnel struct {
+	ID            int          `json:"id"`
+	WebsiteID     int          `json:"websiteId"` // Foreign key to Website model
+	Name          string       `json:"name"`
+	Steps         []FunnelStep `json:"steps"`
+	WindowMinutes int          `json:"windowMinutes"`
+	CreatedAt     time.Time    `json:"created_at"`
+}
+
+type FunnelReceiver struct {
+	Name          string       `json:"name"`
+	Steps         []FunnelStep `json:"steps"`
+	WindowMinutes int          `json:"windowMinutes"`
+}
+
+// Normalize trims the step definitions and fills in the default window
+func (f *FunnelReceiver) Normalize() {
+	f.Name = strings.TrimSpace(f.Name)
+	for i := range f.Steps {
+		f.Steps[i].Type = strings.ToLower(strings.TrimSpace(f.Steps[i].Type))
+		f.Steps[i].Pathname = strings.TrimSpace(f.Steps[i].Pathname)
+		f.Steps[i].EventName = strings.TrimSpace(f.Steps[i].EventName)
+	}
+	if f.WindowMinutes == 0 {
+		f.WindowMinutes = DefaultFunnelWindowMin
+	}
+}
+
+func (f *FunnelReceiver) ValidateFunnel() error {
+	if f.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(f.Name) > 100 {
+		return errors.New("name must be at most 100 characters long")
+	}
+	if len(f.Steps) < MinFunnelSteps || len(f.Steps) > MaxFunnelSteps {
+		return fmt.Errorf("a funnel must have between %d and %d steps", MinFunnelSteps, MaxFunnelSteps)
+	}
+	if f.WindowMinutes < 1 || f.WindowMinutes > MaxFunnelWindowMin {
+		return fmt.Errorf("windowMinutes must be between 1 and %d", MaxFunnelWindowMin)
+	}
+
+	for i, step := range f.Steps {
+		switch step.Type {
+		case GoalTypePageview:
+			if !strings.HasPrefix(step.Pathname, "/") || step.EventName != "" {
+				return fmt.Errorf("step %d: pageview steps need a pathname starting with / and no event name", i+1)
+			}
+			if len(step.Pathname) > 500 {
+				return fmt.Errorf("step %d: pathname must be at most 500 characters long", i+1)
+			}
+		case GoalTypeEvent:
+			if step.EventName == "" || step.Pathname != "" {
+				return fmt.Errorf("step %d: event steps need an event name and no pathname", i+1)
+			}
+			if len(step.EventName) > 500 {
+				return fmt.Errorf("step %d: event name must be at most 500 characters long", i+1)
+			}
+		default:
+			return fmt.Errorf("step %d: type must be one of pageview or event", i+1)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Types of goals
+const (
+	GoalTypePageview = "pageview" // a visit to a pathname matching the pattern
+	GoalTypeEvent    = "event"    // an event with the given name, and optionally a property value
+)
+
+// Goal defines what counts as a conversion on a website. Pathname patterns can contain * wildcards, e.g. /blog/*.
+type Goal struct {
+	ID            int       `json:"id"`
+	WebsiteID     int       `json:"websiteId"` // Foreign key to Website model
+	Name          string    `json:"name"`
+	Type          string    `json:"type"`
+	Pathname      string    `json:"pathname,omitempty"`
+	EventName     string    `json:"eventName,omitempty"`
+	PropertyKey   string    `json:"propertyKey,omitempty"`
+	PropertyValue string    `json:"propertyValue,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// PathnameLikePattern turns the pathname pattern of a pageview goal into a LIKE pattern, escaping the characters LIKE treats as wildcards
+func (g *Goal) PathnameLikePattern() string {
+	return pathnameLikePattern(g.Pathname)
+}
+
+func pathnameLikePattern(pathname string) string {
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(pathname)
+	return strings.ReplaceAll(pattern, "*", "%")
+}
+
+type GoalReceiver struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Pathname      string `json:"pathname"`
+	EventName     string `json:"eventName"`
+	PropertyKey   string `json:"propertyKey"`
+	PropertyValue string `json:"propertyValue"`
+}
+
+func (g *GoalReceiver) ValidateGoal() error {
+	if g.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(g.Name) > 100 {
+		return errors.New("name must be at most 100 characters long")
+	}
+
+	switch g.Type {
+	case GoalTypePageview:
+		if !strings.HasPrefix(g.Pathname, "/") {
+			return errors.New("pageview goals need a pathname starting with /")
+		}
+		if len(g.Pathname) > 500 {
+			return errors.New("pathname must be at most 500 characters long")
+		}
+		if g.EventName != "" || g.PropertyKey != "" || g.PropertyValue != "" {
+			return errors.New("pageview goals can't have an event name or a property")
+		}
+	case GoalTypeEvent:
+		if g.EventName == "" {
+			return errors.New("event goals need an event name")
+		}
+		if len(g.EventName) > 500 {
+			return errors.New("event name must be at most 500 characters long")
+		}
+		if g.Pathname != "" {
+			return errors.New("event goals can't have a pathname")
+		}
+		if (g.PropertyKey == "") != (g.PropertyValue == "") {
+			return errors.New("propertyKey and propertyValue must be set together")
+		}
+		if len(g.PropertyKey) > MaxEventPropertyKeyLen {
+			return fmt.Errorf("propertyKey must be at most %d characters long", MaxEventPropertyKeyLen)
+		}
+		if len(g.PropertyValue) > MaxEventPropertyValueLen {
+			return fmt.Errorf("propertyValue must be at most %d characters long", MaxEventPropertyValueLen)
+		}
+	default:
+		return errors.New("type must be one of pageview or event")
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"encoding/json"
+	"math"
 	"time"
 
 	"github.com/mvavassori/flockcounter/utils"
@@ -14,15 +15,26 @@ type Visit struct {
 	WebsiteDomain   string         `json:"websiteDomain"`
 	Timestamp       time.Time      `json:"timestamp"`
 	Referrer        string         `json:"referrer"`
+	ReferrerSource  string         `json:"referrerSource"` // friendly name of the referrer, e.g. Google
 	URL             string         `json:"url"`
+	Hostname        string         `json:"hostname"`
 	Pathname        string         `json:"pathname"`
 	DeviceType      string         `json:"deviceType"`
 	OS              string         `json:"os"`
+	OSVersion       string         `json:"osVersion"`
 	Browser         string         `json:"browser"`
+	BrowserVersion  string         `json:"browserVersion"`
+	ScreenSize      string         `json:"screenSize"`
 	Language        string         `json:"language"`
 	Country         string         `json:"country"`
 	Region          string         `json:"region"`
 	City            string         `json:"city"`
+	CountryCode     string         `json:"countryCode"` // ISO 3166-1 alpha-2
+	RegionCode      string         `json:"regionCode"`  // ISO 3166-2
+	Continent       string         `json:"continent"`   // continent code
+	ASN             int            `json:"asn"`         // autonomous system of the visitor, 0 if unknown
+	ASNOrg          string         `json:"asnOrg"`
+	IsDatacenter    bool           `json:"isDatacenter"`
 	TimeSpentOnPage int            `json:"timeSpentOnPage"`
 	IsUnique        bool           `json:"isUnique"`
 	UTMSource       sql.NullString `json:"utmSource"`
@@ -30,6 +42,9 @@ type Visit struct {
 	UTMCampaign     sql.NullString `json:"utmCampaign"`
 	UTMTerm         sql.NullString `json:"utmTerm"`
 	UTMContent      sql.NullString `json:"utmContent"`
+	Channel         string         `json:"channel"`
+	ScrollDepth     *int           `json:"scrollDepth"` // maximum scroll depth reached on the page, in percent
+	WebVitals
 }
 
 type VisitReceiver struct {
@@ -40,6 +55,10 @@ type VisitReceiver struct {
 	UserAgent       string    `json:"userAgent"`
 	Language        string    `json:"language"`
 	TimeSpentOnPage int       `json:"timeSpentOnPage"`
+	IP              string    `json:"ip"`          // visitor IP, only honoured for server-side visits sent with an ingest key
+	ScrollDepth     *int      `json:"scrollDepth"` // optional, maximum scroll depth reached on the page, in percent
+	ScreenWidth     int       `json:"screenWidth"` // optional, screen width in CSS pixels, stored as a bucket
+	WebVitals                 // optional, only sent for the first pageview of a page load
 }
 
 type VisitInsert struct {
@@ -47,15 +66,29 @@ type VisitInsert struct {
 	WebsiteDomain   string         `json:"websiteDomain"`
 	Timestamp       time.Time      `json:"timestamp"`
 	Referrer        string         `json:"referrer"`
+	ReferrerSource  string         `json:"referrerSource"` // friendly name of the referrer, e.g. Google
 	URL             string         `json:"url"`
+	Hostname        string         `json:"hostname"`
 	Pathname        string         `json:"pathname"`
 	DeviceType      string         `json:"deviceType"`
 	OS              string         `json:"os"`
+	OSVersion       string         `json:"osVersion"` // e.g. 11 for Windows, 14.4 for macOS, empty if unknown
 	Browser         string         `json:"browser"`
+	BrowserVersion  string         `json:"browserVersion"` // major version, major.minor for Safari
+	ScreenSize      string         `json:"screenSize"`     // screen width bucket, e.g. 1440-1919px
 	Language        string         `json:"language"`
 	Country         string         `json:"country"`
 	Region          string         `json:"region"`
 	City            string         `json:"city"`
+	CountryCode     string         `json:"countryCode"` // ISO 3166-1 alpha-2
+	RegionCode      string         `json:"regionCode"`  // ISO 3166-2
+	Continent       string         `json:"continent"`   // continent code
+	CountryID       uint           `json:"countryId"`   // GeoNames IDs the localized names are resolved from, 0 if unknown
+	RegionID        uint           `json:"regionId"`
+	CityID          uint           `json:"cityId"`
+	ASN             uint           `json:"asn"` // autonomous system of the visitor, 0 without an ASN database
+	ASNOrg          string         `json:"asnOrg"`
+	IsDatacenter    bool           `json:"isDatacenter"` // the ASN belongs to a cloud, hosting or datacenter provider
 	IsUnique        bool           `json:"isUnique"`
 	TimeSpentOnPage int            `json:"timeSpentOnPage"`
 	UTMSource       sql.NullString `json:"utmSource"`
@@ -63,6 +96,44 @@ type VisitInsert struct {
 	UTMCampaign     sql.NullString `json:"utmCampaign"`
 	UTMTerm         sql.NullString `json:"utmTerm"`
 	UTMContent      sql.NullString `json:"utmContent"`
+	Channel         string         `json:"channel"`
+	VisitorID       string         `json:"-"` // daily hashed visitor identifier, never exposed
+	SessionID       int64          `json:"sessionId"`
+	ScrollDepth     *int           `json:"scrollDepth"`
+	WebVitals
+}
+
+// Web vitals above these values are measurement glitches (or made up) and are discarded
+const (
+	MaxWebVitalMs  = 60000 // LCP, INP, FCP and TTFB
+	MaxWebVitalCLS = 10
+)
+
+// WebVitals holds the Core Web Vitals measured by the tracker on a page load. Every value is optional.
+type WebVitals struct {
+	LCP  *float64 `json:"lcp"`  // Largest Contentful Paint, in milliseconds
+	CLS  *float64 `json:"cls"`  // Cumulative Layout Shift, unitless
+	INP  *float64 `json:"inp"`  // Interaction to Next Paint, in milliseconds
+	FCP  *float64 `json:"fcp"`  // First Contentful Paint, in milliseconds
+	TTFB *float64 `json:"ttfb"` // Time to First Byte, in milliseconds
+}
+
+// Sanitized returns a copy of the web vitals without the negative and implausibly large values
+func (v WebVitals) Sanitized() WebVitals {
+	return WebVitals{
+		LCP:  plausibleVital(v.LCP, MaxWebVitalMs),
+		CLS:  plausibleVital(v.CLS, MaxWebVitalCLS),
+		INP:  plausibleVital(v.INP, MaxWebVitalMs),
+		FCP:  plausibleVital(v.FCP, MaxWebVitalMs),
+		TTFB: plausibleVital(v.TTFB, MaxWebVitalMs),
+	}
+}
+
+func plausibleVital(value *float64, maxValue float64) *float64 {
+	if value == nil || math.IsNaN(*value) || *value < 0 || *value > maxValue {
+		return nil
+	}
+	return value
 }
 
 // MarshalJSON customizes the JSON encoding for the Visit struct.
@@ -3,7 +3,15 @@ package models
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 // these fields can be null because there can be a user without websites, and i am returning websites along the user when calling GetUSer
@@ -51,3 +59,279 @@ func (w *Website) MarshalJSON() ([]byte, error) {
 		Alias:     (*Alias)(w),
 	})
 }
+
+// WebsiteSettings holds the per website ingestion settings
+type WebsiteSettings struct {
+	KeepBots           bool `json:"keepBots"`           // store bot and crawler traffic instead of discarding it
+	LowercasePaths     bool `json:"lowercasePaths"`     // store pathnames in lowercase
+	StripTrailingSlash bool `json:"stripTrailingSlash"` // store /about/ as /about
+	CollapseIndex      bool `json:"collapseIndex"`      // store /docs/index.html as /docs/
+	HashRouting        bool `json:"hashRouting"`        // the page path is in the url fragment (#/path), for single-page apps using hash routing
+	ExcludeDatacenter  bool `json:"excludeDatacenter"`  // discard the traffic from cloud and hosting networks instead of storing it flagged as datacenter traffic
+}
+
+// WebsiteSettingsUpdate uses pointers so that only the settings present in the request body get updated
+type WebsiteSettingsUpdate struct {
+	KeepBots           *bool `json:"keepBots"`
+	LowercasePaths     *bool `json:"lowercasePaths"`
+	StripTrailingSlash *bool `json:"stripTrailingSlash"`
+	CollapseIndex      *bool `json:"collapseIndex"`
+	HashRouting        *bool `json:"hashRouting"`
+	ExcludeDatacenter  *bool `json:"excludeDatacenter"`
+}
+
+// WebsiteHostname is an extra hostname a website accepts hits from besides its registered domain. It is either an exact hostname (e.g. staging.example.com) or a wildcard covering every subdomain (e.g. *.example.com).
+type WebsiteHostname struct {
+	ID        int       `json:"id"`
+	WebsiteID int       `json:"websiteId"` // Foreign key to Website model
+	Hostname  string    `json:"hostname"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebsiteHostnameReceiver struct {
+	Hostname string `json:"hostname"`
+}
+
+var hostnameRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ValidateHostname expects a lowercase hostname, optionally prefixed by "*." to match every subdomain
+func (h *WebsiteHostnameReceiver) ValidateHostname() error {
+	if h.Hostname == "" {
+		return errors.New("hostname is required")
+	}
+	if len(h.Hostname) > 253 {
+		return errors.New("hostname must be at most 253 characters long")
+	}
+
+	hostname := strings.TrimPrefix(h.Hostname, "*.")
+	if strings.Contains(hostname, "*") {
+		return errors.New("wildcards are only allowed as the first label, e.g. *.example.com")
+	}
+	if !hostnameRegex.MatchString(hostname) {
+		return errors.New("invalid hostname format")
+	}
+	if hostname != h.Hostname && !strings.Contains(hostname, ".") {
+		return errors.New("wildcard hostnames must cover a domain, e.g. *.example.com")
+	}
+	// A wildcard on a public suffix (e.g. *.co.uk, *.github.io) would take the hits of every site registered under it
+	if suffix, _ := publicsuffix.PublicSuffix(hostname); hostname != h.Hostname && suffix == hostname {
+		return errors.New("wildcard hostnames can't cover a public suffix, e.g. use *.example.co.uk instead of *.co.uk")
+	}
+
+	return nil
+}
+
+// ValidateOwnership checks that the hostname is under the registered domain (eTLD+1) of the website domain, e.g. staging.example.com or *.example.com for app.example.com, so that a website can't take the hits of domains its owner doesn't control
+func (h *WebsiteHostnameReceiver) ValidateOwnership(domain string) error {
+	registeredDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		registeredDomain = domain
+	}
+
+	hostname := strings.TrimPrefix(h.Hostname, "*.")
+	if hostname != registeredDomain && !strings.HasSuffix(hostname, "."+registeredDomain) {
+		return fmt.Errorf("hostname must be %s or one of its subdomains", registeredDomain)
+	}
+	return nil
+}
+
+// IngestKey authenticates server-side visits and events of a website. Only a hash of the key is stored, the key itself is returned once on creation.
+type IngestKey struct {
+	ID         int        `json:"id"`
+	WebsiteID  int        `json:"websiteId"` // Foreign key to Website model
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // first characters of the key, to tell keys apart
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type IngestKeyReceiver struct {
+	Name string `json:"name"`
+}
+
+// IngestKeyCreated is returned when a key is created, it's the only time the full key is available
+type IngestKeyCreated struct {
+	IngestKey
+	Key string `json:"key"`
+}
+
+func (k *IngestKeyReceiver) ValidateIngestKey() error {
+	if k.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(k.Name) > 100 {
+		return errors.New("name must be at most 100 characters long")
+	}
+	return nil
+}
+
+// Types of the per website referrer block rules
+const (
+	ReferrerRuleExact  = "exact"  // the referrer host is the pattern
+	ReferrerRuleSuffix = "suffix" // the referrer host is the pattern or one of its subdomains
+	ReferrerRuleRegex  = "regex"  // the pattern matches the referrer host and path
+)
+
+// ReferrerRule discards the visits and events of a website coming from a spam referrer
+type ReferrerRule struct {
+	ID        int       `json:"id"`
+	WebsiteID int       `json:"websiteId"` // Foreign key to Website model
+	Type      string    `json:"type"`
+	Pattern   string    `json:"pattern"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ReferrerRuleReceiver struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+}
+
+func (rr *ReferrerRuleReceiver) ValidateReferrerRule() error {
+	if rr.Pattern == "" {
+		return errors.New("pattern is required")
+	}
+	if len(rr.Pattern) > 500 {
+		return errors.New("pattern must be at most 500 characters long")
+	}
+
+	switch rr.Type {
+	case ReferrerRuleExact, ReferrerRuleSuffix:
+		if !hostnameRegex.MatchString(rr.Pattern) {
+			return errors.New("exact and suffix patterns must be hostnames, e.g. spam.example.com")
+		}
+	case ReferrerRuleRegex:
+		if _, err := regexp.Compile(rr.Pattern); err != nil {
+			return errors.New("invalid regex pattern")
+		}
+	default:
+		return errors.New("type must be one of exact, suffix or regex")
+	}
+
+	return nil
+}
+
+// PathnameRewrite replaces the parts of a pathname matching Pattern with Replacement (e.g. /users/\d+ with /users/:id) before it is stored. Rewrites run in Position order, after the pathname settings of the website.
+type PathnameRewrite struct {
+	ID          int       `json:"id"`
+	WebsiteID   int       `json:"websiteId"` // Foreign key to Website model
+	Position    int       `json:"position"`
+	Pattern     string    `json:"pattern"`
+	Replacement string    `json:"replacement"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type PathnameRewriteReceiver struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	Position    *int   `json:"position"` // optional, the rewrite is appended after the existing ones if missing
+}
+
+func (pr *PathnameRewriteReceiver) ValidatePathnameRewrite() error {
+	if pr.Pattern == "" {
+		return errors.New("pattern is required")
+	}
+	if len(pr.Pattern) > 500 || len(pr.Replacement) > 500 {
+		return errors.New("pattern and replacement must be at most 500 characters long")
+	}
+	if _, err := regexp.Compile(pr.Pattern); err != nil {
+		return errors.New("invalid regex pattern")
+	}
+	if pr.Position != nil && *pr.Position < 0 {
+		return errors.New("position must be a positive number")
+	}
+	return nil
+}
+
+// Types of the per website exclusion rules
+const (
+	ExclusionRuleIP       = "ip"       // the pattern is a CIDR range matched against the visitor ip
+	ExclusionRulePathname = "pathname" // the pattern is a pathname where * matches any characters, e.g. /admin/*
+	ExclusionRuleHostname = "hostname" // the pattern is a hostname, optionally prefixed by "*." to match every subdomain. Only hostnames the website accepts (its domain and aliases) reach the rules, hits from other hostnames are dropped as unregistered.
+)
+
+// ExclusionRule discards the visits and events of a website matching the pattern (internal traffic, test runs, admin pages)
+type ExclusionRule struct {
+	ID        int       `json:"id"`
+	WebsiteID int       `json:"websiteId"` // Foreign key to Website model
+	Type      string    `json:"type"`
+	Pattern   string    `json:"pattern"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExclusionRuleReceiver struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+}
+
+// Normalize trims the rule, lowercases hostnames and turns a single ip address into its /32 (or /128) range
+func (er *ExclusionRuleReceiver) Normalize() {
+	er.Type = strings.ToLower(strings.TrimSpace(er.Type))
+	er.Pattern = strings.TrimSpace(er.Pattern)
+
+	switch er.Type {
+	case ExclusionRuleHostname:
+		er.Pattern = strings.ToLower(er.Pattern)
+	case ExclusionRuleIP:
+		if ip := net.ParseIP(er.Pattern); ip != nil {
+			if ip.To4() != nil {
+				er.Pattern += "/32"
+			} else {
+				er.Pattern += "/128"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(er.Pattern); err == nil {
+			er.Pattern = ipNet.String()
+		}
+	}
+}
+
+func (er *ExclusionRuleReceiver) ValidateExclusionRule() error {
+	if er.Pattern == "" {
+		return errors.New("pattern is required")
+	}
+	if len(er.Pattern) > 500 {
+		return errors.New("pattern must be at most 500 characters long")
+	}
+
+	switch er.Type {
+	case ExclusionRuleIP:
+		if _, _, err := net.ParseCIDR(er.Pattern); err != nil {
+			return errors.New("ip patterns must be an ip address or a CIDR range, e.g. 203.0.113.0/24")
+		}
+	case ExclusionRulePathname:
+		if !strings.HasPrefix(er.Pattern, "/") && !strings.HasPrefix(er.Pattern, "*") {
+			return errors.New("pathname patterns must start with / or *, e.g. /admin/*")
+		}
+	case ExclusionRuleHostname:
+		hostnameReceiver := WebsiteHostnameReceiver{Hostname: er.Pattern}
+		if err := hostnameReceiver.ValidateHostname(); err != nil {
+			return err
+		}
+	default:
+		return errors.New("type must be one of ip, pathname or hostname")
+	}
+
+	return nil
+}
+
+// ExclusionTestReceiver is a sample request checked against the exclusion rules of a website without storing anything
+type ExclusionTestReceiver struct {
+	IP  string `json:"ip"`
+	URL string `json:"url"` // page url, e.g. https://staging.example.com/admin
+}
+
+func (et *ExclusionTestReceiver) ValidateExclusionTest() error {
+	if et.IP == "" && et.URL == "" {
+		return errors.New("ip or url is required")
+	}
+	if et.IP != "" && net.ParseIP(et.IP) == nil {
+		return errors.New("invalid ip address")
+	}
+	if et.URL != "" {
+		if parsedURL, err := url.Parse(et.URL); err != nil || parsedURL.Hostname() == "" {
+			return errors.New("url must be an absolute url, e.g. https://example.com/admin")
+		}
+	}
+	return nil
+}
@@ -73,7 +73,7 @@ function trackMailtoLink(event) {
   sendEventData(eventData);
 }
 
-function trackCustomEvent(eventName) {
+function trackCustomEvent(eventName, properties = {}) {
   const eventData = {
     type: "custom_event",
     timestamp: new Date().toISOString(),
@@ -83,6 +83,7 @@ function trackCustomEvent(eventName) {
     userAgent: navigator.userAgent,
     language: navigator.language,
     name: eventName,
+    properties: properties,
   };
   sendEventData(eventData);
 }
@@ -137,9 +138,16 @@ document.addEventListener("DOMContentLoaded", () => {
     // Extract the event name from the class
     const classList = element.className.split(" ");
     let eventName = "";
+    const properties = {};
     classList.forEach((cls) => {
       if (cls.startsWith("data-event-name=")) {
         eventName = cls.split("=")[1];
+      } else if (cls.startsWith("data-event-prop-")) {
+        // e.g. data-event-prop-plan=pro
+        const [key, value] = cls.slice("data-event-prop-".length).split("=");
+        if (key && value !== undefined) {
+          properties[key] = value;
+        }
       }
     });
 
@@ -156,7 +164,7 @@ document.addEventListener("DOMContentLoaded", () => {
       }
 
       // Track the event
-      trackCustomEvent(eventName);
+      trackCustomEvent(eventName, properties);
     });
   });
 });
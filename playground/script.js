@@ -18,8 +18,77 @@ console.log("window.location.host", window.location.host);
 
 let previousPathname = window.location.pathname;
 
+// Single-page apps routing with the url fragment (#/path) must set data-hash-routing="true" on the script tag, the tracker doesn't read the hash routing setting of the website, which has to be enabled too
+const hashRouting =
+  document.currentScript !== null &&
+  document.currentScript.dataset.hashRouting === "true";
+
+// Without hash routing a change of the fragment alone (e.g. an anchor link) is not a new page
+function isSamePage(url, otherUrl) {
+  if (hashRouting) {
+    return url === otherUrl;
+  }
+  return url.split("#")[0] === otherUrl.split("#")[0];
+}
+
 console.log("Page loaded, startTime:", startTime);
 
+// Maximum scroll depth reached on the current page, in percent
+let maxScrollDepth = 0;
+
+function updateScrollDepth() {
+  const scrollable = document.documentElement.scrollHeight - window.innerHeight;
+  const depth = scrollable > 0 ? Math.round((window.scrollY / scrollable) * 100) : 100;
+  maxScrollDepth = Math.max(maxScrollDepth, Math.min(depth, 100));
+}
+
+window.addEventListener("scroll", updateScrollDepth, { passive: true });
+window.addEventListener("load", updateScrollDepth);
+
+// Core Web Vitals of the page load, sent with the first visit only
+const webVitals = {};
+let webVitalsSent = false;
+
+function observeWebVitals() {
+  if (typeof PerformanceObserver === "undefined") {
+    return;
+  }
+  const observe = (type, callback) => {
+    try {
+      new PerformanceObserver((list) => list.getEntries().forEach(callback)).observe({ type, buffered: true });
+    } catch (e) {
+      // Entry type not supported by this browser
+    }
+  };
+
+  observe("largest-contentful-paint", (entry) => {
+    webVitals.lcp = entry.startTime;
+  });
+  observe("paint", (entry) => {
+    if (entry.name === "first-contentful-paint") {
+      webVitals.fcp = entry.startTime;
+    }
+  });
+  observe("layout-shift", (entry) => {
+    if (!entry.hadRecentInput) {
+      webVitals.cls = (webVitals.cls || 0) + entry.value;
+    }
+  });
+  // Approximation of INP: the slowest interaction of the page
+  observe("event", (entry) => {
+    if (entry.interactionId && (webVitals.inp === undefined || entry.duration > webVitals.inp)) {
+      webVitals.inp = entry.duration;
+    }
+  });
+
+  const navigation = performance.getEntriesByType("navigation")[0];
+  if (navigation) {
+    webVitals.ttfb = navigation.responseStart;
+  }
+}
+
+observeWebVitals();
+
 // Function to handle sending the visit data
 function sendVisit(elapsedTime) {
   const now = new Date();
@@ -32,7 +101,13 @@ function sendVisit(elapsedTime) {
     userAgent: navigator.userAgent,
     language: navigator.language,
     timeSpentOnPage: Math.round(elapsedTime),
+    scrollDepth: maxScrollDepth,
+    screenWidth: window.screen.width,
   };
+  if (!webVitalsSent) {
+    Object.assign(payloadData, webVitals);
+    webVitalsSent = true;
+  }
   let data = JSON.stringify(payloadData);
   console.log("Sending visit data:", payloadData);
   navigator.sendBeacon(backendUrl, data);
@@ -79,6 +154,9 @@ window.addEventListener("visibilitychange", (event) => {
 
 // Event listener for route changes
 window.addEventListener("popstate", handleRouteChange);
+if (hashRouting) {
+  window.addEventListener("hashchange", handleRouteChange);
+}
 window.history.pushState = overridePushStateFunction(window.history.pushState);
 window.history.replaceState = overrideReplaceStateFunction(
   window.history.replaceState
@@ -98,7 +176,7 @@ function handleRouteChange() {
     referrer = "Direct";
   }
 
-  if (newUrl !== currentUrl) {
+  if (!isSamePage(newUrl, currentUrl)) {
     // Store the current URL as the previous referrer
     currentReferrer = referrer;
 
@@ -121,6 +199,8 @@ function handleRouteChange() {
     } else {
       sendVisit(totalElapsedTime);
       currentUrl = newUrl;
+      maxScrollDepth = 0;
+      updateScrollDepth();
       startTime = performance.now();
       totalElapsedTime = 0;
       console.log(
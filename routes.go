@@ -6,27 +6,32 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mvavassori/flockcounter/handlers"
 	"github.com/mvavassori/flockcounter/middleware"
-	"github.com/oschwald/geoip2-golang"
+	"github.com/mvavassori/flockcounter/services"
+	"github.com/mvavassori/flockcounter/utils"
 )
 
-func SetupRouter(postgresDB *sql.DB, geoipDB *geoip2.Reader) *mux.Router {
+func SetupRouter(postgresDB *sql.DB, geolocator utils.Geolocator, asnDB *utils.GeoIPDatabase, ingestQueue *services.IngestQueue, rateLimits *middleware.RateLimits) *mux.Router {
 
 	router := mux.NewRouter()
 
+	// ingest routes locate the visitors with the geolocator, plus their network when an ASN database is configured
+	locator := utils.WithASN(geolocator, asnDB)
+
 	// visit routes
 	router.Handle("/api/visits", middleware.Admin(handlers.GetVisits(postgresDB))).Methods("GET")
-	router.HandleFunc("/api/visit", handlers.CreateVisit(postgresDB, geoipDB)).Methods("POST")
+	router.Handle("/api/visit", rateLimits.Ingest(handlers.CreateVisit(postgresDB, locator, ingestQueue))).Methods("POST")
+	router.Handle("/api/visits/batch", rateLimits.Ingest(handlers.CreateVisitsBatch(postgresDB, locator))).Methods("POST")
 	router.Handle("/api/visit/{id}", middleware.Admin(handlers.DeleteVisit(postgresDB))).Methods("DELETE")
 
 	// user routes
 	router.Handle("/api/users", middleware.Admin(handlers.GetUsers(postgresDB))).Methods("GET")
 	router.Handle("/api/user/{id}", middleware.AdminOrOwner(handlers.GetUser(postgresDB))).Methods("GET")
-	router.HandleFunc("/api/user", handlers.CreateUser(postgresDB, false)).Methods("POST") // false to indicate that we'll create a regular user
+	router.Handle("/api/user", rateLimits.Signup(handlers.CreateUser(postgresDB, false))).Methods("POST") // false to indicate that we'll create a regular user
 	router.Handle("/api/user/{id}", middleware.AdminOrOwner(handlers.UpdateUser(postgresDB))).Methods("PATCH")
 	router.Handle("/api/user/{id}", middleware.AdminOrOwner(handlers.DeleteUser(postgresDB))).Methods("DELETE")
 
 	// auth routes
-	router.HandleFunc("/api/user/login", handlers.Login(postgresDB)).Methods("POST")
+	router.Handle("/api/user/login", rateLimits.Login(handlers.Login(postgresDB))).Methods("POST")
 	router.HandleFunc("/api/user/refresh-token", handlers.RefreshToken(postgresDB)).Methods("POST")
 	router.Handle("/api/user/change-password/{id}", middleware.AdminOrOwner(handlers.ChangePassword(postgresDB))).Methods("PATCH")
 
@@ -34,34 +39,87 @@ func SetupRouter(postgresDB *sql.DB, geoipDB *geoip2.Reader) *mux.Router {
 	router.Handle("/api/admin/user", middleware.Admin(handlers.CreateUser(postgresDB, true))).Methods("POST") // true to indicate that we'll create an admin user
 	// router.HandleFunc("/api/admin/user", handlers.CreateUser(postgresDB, true)).Methods("POST") // just to create the first admin user
 
+	// admin ingest routes
+	router.Handle("/api/admin/ingest/stats", middleware.Admin(handlers.GetIngestQueueStats(ingestQueue))).Methods("GET")
+	router.Handle("/api/admin/referrer-spam/reload", middleware.Admin(handlers.ReloadReferrerSpamList())).Methods("POST")
+	if geoipDB, ok := geolocator.(*utils.GeoIPDatabase); ok {
+		router.Handle("/api/admin/geoip/reload", middleware.Admin(handlers.ReloadGeoIPDatabase(geoipDB))).Methods("POST")
+	}
+	if asnDB != nil {
+		router.Handle("/api/admin/geoip/asn/reload", middleware.Admin(handlers.ReloadGeoIPDatabase(asnDB))).Methods("POST")
+	}
+
 	// website routes
 	router.Handle("/api/websites", middleware.Admin(handlers.GetWebsites(postgresDB))).Methods("GET")
 	router.Handle("/api/websites/user/{id}", middleware.AdminOrOwner(handlers.GetUserWebsites(postgresDB))).Methods("GET")
 	router.Handle("/api/website", middleware.AdminOrAuth(handlers.CreateWebsite(postgresDB))).Methods("POST")
 	// router.Handle("/api/website/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.UpdateWebsite(postgresDB))).Methods("PUT")
 	router.Handle("/api/website/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeleteWebsite(postgresDB))).Methods("DELETE")
+	router.Handle("/api/website/{domain}/settings", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetWebsiteSettings(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/settings", middleware.AdminOrUserWebsite(postgresDB)(handlers.UpdateWebsiteSettings(postgresDB))).Methods("PATCH")
+	router.Handle("/api/website/{domain}/hostnames", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetWebsiteHostnames(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/hostnames", middleware.AdminOrUserWebsite(postgresDB)(handlers.AddWebsiteHostname(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/hostnames/{hostname}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeleteWebsiteHostname(postgresDB))).Methods("DELETE")
+	router.Handle("/api/website/{domain}/referrer-rules", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetReferrerRules(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/referrer-rules", middleware.AdminOrUserWebsite(postgresDB)(handlers.CreateReferrerRule(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/referrer-rules/{id}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeleteReferrerRule(postgresDB))).Methods("DELETE")
+	router.Handle("/api/website/{domain}/pathname-rules", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetPathnameRewrites(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/pathname-rules", middleware.AdminOrUserWebsite(postgresDB)(handlers.CreatePathnameRewrite(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/pathname-rules/{id}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeletePathnameRewrite(postgresDB))).Methods("DELETE")
+	// rewriting the stored history is never allowed through the public demo domain
+	router.Handle("/api/website/{domain}/pathname-rules/apply", middleware.AdminOrWebsiteOwner(postgresDB)(handlers.ApplyPathnameRules(postgresDB))).Methods("POST")
+	// exclusion rules list the office and home IPs of the owner, so they are never exposed through the public demo domain
+	router.Handle("/api/website/{domain}/exclusion-rules", middleware.AdminOrWebsiteOwner(postgresDB)(handlers.GetExclusionRules(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/exclusion-rules", middleware.AdminOrUserWebsite(postgresDB)(handlers.CreateExclusionRule(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/exclusion-rules/test", middleware.AdminOrUserWebsite(postgresDB)(handlers.TestExclusionRules(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/exclusion-rules/{id}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeleteExclusionRule(postgresDB))).Methods("DELETE")
+	router.Handle("/api/website/{domain}/goals", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetGoals(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/goals", middleware.AdminOrUserWebsite(postgresDB)(handlers.CreateGoal(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/goals/{id}", middleware.AdminOrUserWebsite(postgresDB)(handlers.UpdateGoal(postgresDB))).Methods("PUT")
+	router.Handle("/api/website/{domain}/goals/{id}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeleteGoal(postgresDB))).Methods("DELETE")
+	router.Handle("/api/website/{domain}/funnels", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetFunnels(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/funnels", middleware.AdminOrUserWebsite(postgresDB)(handlers.CreateFunnel(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/funnels/{id}", middleware.AdminOrUserWebsite(postgresDB)(handlers.DeleteFunnel(postgresDB))).Methods("DELETE")
+	// ingest keys are secrets, so they are never exposed through the public demo domain
+	router.Handle("/api/website/{domain}/ingest-keys", middleware.AdminOrWebsiteOwner(postgresDB)(handlers.GetIngestKeys(postgresDB))).Methods("GET")
+	router.Handle("/api/website/{domain}/ingest-keys", middleware.AdminOrWebsiteOwner(postgresDB)(handlers.CreateIngestKey(postgresDB))).Methods("POST")
+	router.Handle("/api/website/{domain}/ingest-keys/{id}", middleware.AdminOrWebsiteOwner(postgresDB)(handlers.RevokeIngestKey(postgresDB))).Methods("DELETE")
 
 	// dashboard routes
 	router.Handle("/api/dashboard/top-stats/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetTopStats(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/pages/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetPages(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/scroll-depth/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetScrollDepth(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/entry-pages/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetSessionPages(postgresDB, "entry_page"))).Methods("GET")
+	router.Handle("/api/dashboard/exit-pages/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetSessionPages(postgresDB, "exit_page"))).Methods("GET")
 	router.Handle("/api/dashboard/referrers/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetReferrers(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/device-types/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetDeviceTypes(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/screen-sizes/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetScreenSizes(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/oses/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetOSes(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/browsers/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetBrowsers(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/languages/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetLanguages(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/hostnames/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetHostnames(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/channels/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetChannels(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/countries/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetCountries(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/regions/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetRegions(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/cities/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetCities(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/asns/{domain}", middleware.Admin(handlers.GetASNs(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/utm_sources/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetUTMParameters(postgresDB, "utm_source"))).Methods("GET")
 	router.Handle("/api/dashboard/utm_mediums/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetUTMParameters(postgresDB, "utm_medium"))).Methods("GET")
 	router.Handle("/api/dashboard/utm_campaigns/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetUTMParameters(postgresDB, "utm_campaign"))).Methods("GET")
 	router.Handle("/api/dashboard/utm_terms/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetUTMParameters(postgresDB, "utm_term"))).Methods("GET")
 	router.Handle("/api/dashboard/utm_contents/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetUTMParameters(postgresDB, "utm_content"))).Methods("GET")
+	router.Handle("/api/dashboard/goals/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetGoalConversions(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/funnels/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetFunnelStats(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/web-vitals/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetWebVitals(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/web-vitals-breakdown/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetWebVitalsBreakdown(postgresDB))).Methods("GET")
 	router.Handle("/api/dashboard/live-pageviews/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetLivePageViews(postgresDB))).Methods("GET")
+	router.Handle("/api/dashboard/filtered-hits/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetFilteredHits(postgresDB))).Methods("GET")
 
 	// events routes
 	router.Handle("/api/events/{domain}", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetEvents(postgresDB))).Methods("GET")
-	router.HandleFunc("/api/event", handlers.CreateEvent(postgresDB, geoipDB)).Methods("POST")
+	router.Handle("/api/events/{domain}/properties", middleware.AdminOrUserWebsite(postgresDB)(handlers.GetEventProperties(postgresDB))).Methods("GET")
+	router.Handle("/api/event", rateLimits.Ingest(handlers.CreateEvent(postgresDB, locator, ingestQueue))).Methods("POST")
+	router.Handle("/api/events/batch", rateLimits.Ingest(handlers.CreateEventsBatch(postgresDB, locator))).Methods("POST")
 
 	// payment routes
 	router.Handle("/api/payment/checkout", middleware.AdminOrAuth(handlers.CreateCheckoutSession(postgresDB))).Methods("POST")
@@ -0,0 +1,185 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mileusna/useragent"
+	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+// PendingEvent is an event that has been parsed from the tracker payload but not yet matched to a website or stored
+type PendingEvent struct {
+	HitInfo
+	Event models.EventInsert
+}
+
+// BuildEvent parses a tracker payload into a PendingEvent without touching Postgres, see BuildVisit for the location, client hints and serverSide arguments
+func BuildEvent(geolocator utils.Geolocator, ip net.IP, locationHeader http.Header, clientHints utils.ClientHints, eventReceiver models.EventReceiver, serverSide bool) (PendingEvent, error) {
+	if serverSide && strings.TrimSpace(eventReceiver.UserAgent) == "" {
+		return PendingEvent{}, ErrMissingUserAgent
+	}
+
+	location := geolocator.Locate(ip, locationHeader)
+
+	ua := useragent.Parse(eventReceiver.UserAgent)
+	device := utils.DetectDevice(&ua, clientHints)
+
+	pageURL, err := url.Parse(eventReceiver.URL)
+	if err != nil {
+		return PendingEvent{}, ErrInvalidURL
+	}
+
+	referrer, referrerHost, err := normalizeReferrer(pageURL, eventReceiver.Referrer)
+	if err != nil {
+		return PendingEvent{}, err
+	}
+
+	if err := eventReceiver.ValidateProperties(); err != nil {
+		return PendingEvent{}, fmt.Errorf("%w: %s", ErrInvalidProperties, err)
+	}
+
+	return PendingEvent{
+		Event: models.EventInsert{
+			Type:         eventReceiver.Type,
+			Name:         eventReceiver.Name,
+			Timestamp:    eventReceiver.Timestamp,
+			Referrer:     referrer,
+			URL:          eventReceiver.URL,
+			Pathname:     eventReceiver.Pathname,
+			DeviceType:   device.Type,
+			OS:           device.OS,
+			Browser:      device.Browser,
+			Language:     eventReceiver.Language,
+			Country:      location.Country,
+			Region:       location.Region,
+			City:         location.City,
+			CountryCode:  location.CountryCode,
+			RegionCode:   location.RegionCode,
+			Continent:    location.Continent,
+			CountryID:    location.CountryID,
+			RegionID:     location.RegionID,
+			CityID:       location.CityID,
+			ASN:          location.ASN,
+			ASNOrg:       location.ASNOrganization,
+			IsDatacenter: location.Datacenter,
+			Properties:   eventReceiver.Properties,
+		},
+		HitInfo: HitInfo{
+			Domain:       pageURL.Hostname(),
+			IPAddress:    string(ip),
+			UserAgent:    eventReceiver.UserAgent,
+			IsBot:        utils.IsBot(&ua),
+			Referrer:     referrer,
+			ReferrerHost: referrerHost,
+			IsDatacenter: location.Datacenter,
+			GeoNames:     location.Names,
+		},
+	}, nil
+}
+
+// ResolveEvent looks up the website the event belongs to, applies the website filters and pathname rules and works out whether the visitor is unique for the day. It returns ErrUnregisteredDomain if no website accepts the hostname, ErrWebsiteMismatch if a server-side event names a hostname of another website, and an error wrapping ErrFiltered if the event must be discarded.
+func ResolveEvent(q Querier, pending *PendingEvent) error {
+	website, err := lookupWebsite(q, pending.Domain)
+	if err != nil {
+		return err
+	}
+
+	if err := checkIngestKeyWebsite(website, pending.HitInfo); err != nil {
+		return err
+	}
+
+	pathname := normalizePathname(website, pagePathname(website, pending.Event.URL, pending.Event.Pathname))
+
+	if err := applyFilters(q, website, pending.HitInfo, pathname); err != nil {
+		return err
+	}
+
+	recordedGeoNames, err := recordGeoNames(q, pending.GeoNames)
+	if err != nil {
+		return err
+	}
+	pending.recordedGeoNames = recordedGeoNames
+
+	// Hashed with the registered domain like visits, so the same visitor gets the same identifier on both
+	identifier, err := visitorIdentifier(website.Domain, pending.IPAddress, pending.UserAgent)
+	if err != nil {
+		return err
+	}
+
+	isUnique, err := checkUniqueVisitor(q, identifier)
+	if err != nil {
+		return err
+	}
+
+	pending.Event.WebsiteID = int64(website.ID)
+	pending.Event.WebsiteDomain = website.Domain
+	pending.Event.Pathname = pathname
+	pending.Event.IsUnique = isUnique
+	pending.Event.VisitorID = identifier
+
+	return nil
+}
+
+var eventColumns = []string{"website_id", "website_domain", "type", "name", "timestamp", "referrer", "url", "pathname", "device_type", "os", "browser", "language", "country", "region", "city", "country_code", "region_code", "continent", "country_geoname_id", "region_geoname_id", "city_geoname_id", "asn", "asn_organization", "is_datacenter", "is_unique", "visitor_id", "properties"}
+
+// eventRow returns the values of an event in the same order as eventColumns
+func eventRow(event models.EventInsert) []interface{} {
+	return []interface{}{
+		event.WebsiteID,
+		event.WebsiteDomain,
+		event.Type,
+		event.Name,
+		event.Timestamp,
+		event.Referrer,
+		event.URL,
+		event.Pathname,
+		event.DeviceType,
+		event.OS,
+		event.Browser,
+		event.Language,
+		event.Country,
+		event.Region,
+		event.City,
+		nullString(event.CountryCode),
+		nullString(event.RegionCode),
+		nullString(event.Continent),
+		nullGeoNameID(event.CountryID),
+		nullGeoNameID(event.RegionID),
+		nullGeoNameID(event.CityID),
+		nullASN(event.ASN),
+		nullString(event.ASNOrg),
+		event.IsDatacenter,
+		event.IsUnique,
+		nullString(event.VisitorID),
+		eventProperties(event.Properties),
+	}
+}
+
+// eventProperties encodes the custom properties for the jsonb column
+func eventProperties(properties map[string]string) string {
+	if len(properties) == 0 {
+		return "{}"
+	}
+	encoded, _ := json.Marshal(properties) // a map of strings always encodes
+	return string(encoded)
+}
+
+// InsertEvent stores a resolved event
+func InsertEvent(q Querier, event models.EventInsert) error {
+	return InsertEvents(q, []models.EventInsert{event})
+}
+
+// InsertEvents stores resolved events using multi-row INSERT statements
+func InsertEvents(q Querier, events []models.EventInsert) error {
+	rows := make([][]interface{}, len(events))
+	for i, event := range events {
+		rows[i] = eventRow(event)
+	}
+	return bulkInsert(q, "events", eventColumns, rows)
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mvavassori/flockcounter/models"
+)
+
+// matchExclusionRule returns the first exclusion rule of the website matching the visitor ip, the page hostname or the normalized pathname, nil if none does
+func matchExclusionRule(website ingestWebsite, ip net.IP, hostname, pathname string) *models.ExclusionRule {
+	hostname = strings.ToLower(hostname)
+
+	for i, rule := range website.ExclusionRules {
+		switch rule.Type {
+		case models.ExclusionRuleIP:
+			if ip == nil {
+				continue
+			}
+			_, ipNet, err := net.ParseCIDR(rule.Pattern)
+			if err != nil {
+				log.Printf("Skipping invalid ip exclusion %q: %v", rule.Pattern, err)
+				continue
+			}
+			if ipNet.Contains(ip) {
+				return &website.ExclusionRules[i]
+			}
+		case models.ExclusionRuleHostname:
+			if hostname == rule.Pattern {
+				return &website.ExclusionRules[i]
+			}
+			// Like website aliases, *.example.com matches every subdomain but not example.com itself
+			if suffix, ok := strings.CutPrefix(rule.Pattern, "*"); ok && strings.HasSuffix(hostname, suffix) {
+				return &website.ExclusionRules[i]
+			}
+		case models.ExclusionRulePathname:
+			if pathname == "" {
+				continue
+			}
+			if compiled := website.ExclusionRegexes[i]; compiled != nil && compiled.MatchString(pathname) {
+				return &website.ExclusionRules[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// globRegex turns a pattern where * matches any characters into an anchored regex
+func globRegex(pattern string) string {
+	return "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+}
+
+// ExclusionTestResult reports whether a sample request would be excluded, and by which rule
+type ExclusionTestResult struct {
+	Excluded bool                  `json:"excluded"`
+	Rule     *models.ExclusionRule `json:"rule"`     // first matching rule, null if the request would be stored
+	Hostname string                `json:"hostname"` // hostname of the sample url
+	Accepted bool                  `json:"accepted"` // the hostname of the sample url is the domain or an alias of the website, hits from other hostnames are dropped before the exclusion rules (true if the sample has no url)
+	Pathname string                `json:"pathname"` // pathname of the sample url after the pathname settings and rewrites of the website
+}
+
+// TestExclusionRules checks a sample request against the exclusion rules of the website without storing anything. The ip and the url of the sample are optional, the rules of the missing parts just don't match.
+func TestExclusionRules(q Querier, domain string, sample models.ExclusionTestReceiver) (ExclusionTestResult, error) {
+	result := ExclusionTestResult{Accepted: true}
+
+	website, err := lookupWebsite(q, domain)
+	if err != nil {
+		return result, err
+	}
+
+	if sample.URL != "" {
+		pageURL, err := url.Parse(sample.URL)
+		if err != nil {
+			return result, ErrInvalidURL
+		}
+		pathname := pageURL.Path
+		if pathname == "" {
+			pathname = "/"
+		}
+		result.Hostname = pageURL.Hostname()
+		result.Pathname = normalizePathname(website, pagePathname(website, sample.URL, pathname))
+
+		websiteID, err := WebsiteIDForHostname(q, result.Hostname)
+		if err != nil && err != ErrUnregisteredDomain {
+			return result, err
+		}
+		result.Accepted = websiteID == website.ID
+	}
+
+	// A hostname the website doesn't accept never reaches its exclusion rules
+	if !result.Accepted {
+		return result, nil
+	}
+
+	result.Rule = matchExclusionRule(website, net.ParseIP(sample.IP), result.Hostname, result.Pathname)
+	result.Excluded = result.Rule != nil
+
+	// Ingestion doesn't need the creation date, it's only loaded for the rule reported here
+	if result.Excluded {
+		err := q.QueryRow("SELECT created_at FROM exclusion_rules WHERE id = $1", result.Rule.ID).Scan(&result.Rule.CreatedAt)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// GeoNames IDs whose localized names have already been stored by this process, so that every hit doesn't rewrite them
+var storedGeoNames sync.Map // uint -> struct{}
+
+// recordGeoNames stores the localized names of the given GeoNames IDs in geo_names, where the dashboard resolves country, region and city names in the locale of the user. IDs already stored by this process are skipped, names changed by a newer database are picked up after a restart. It returns the IDs it wrote, to be passed to markGeoNamesStored once the surrounding transaction has been committed.
+func recordGeoNames(q Querier, names map[uint]map[string]string) ([]uint, error) {
+	var geoNameIDs []uint
+	for geoNameID := range names {
+		if _, stored := storedGeoNames.Load(geoNameID); !stored {
+			geoNameIDs = append(geoNameIDs, geoNameID)
+		}
+	}
+	if len(geoNameIDs) == 0 {
+		return nil, nil
+	}
+	// Rows are always written in the same order, so concurrent transactions can't deadlock on them
+	sort.Slice(geoNameIDs, func(i, j int) bool { return geoNameIDs[i] < geoNameIDs[j] })
+
+	var ids []int64
+	var locales, localizedNames []string
+	for _, geoNameID := range geoNameIDs {
+		localeNames := names[geoNameID]
+		sortedLocales := make([]string, 0, len(localeNames))
+		for locale := range localeNames {
+			sortedLocales = append(sortedLocales, locale)
+		}
+		sort.Strings(sortedLocales)
+		for _, locale := range sortedLocales {
+			ids = append(ids, int64(geoNameID))
+			locales = append(locales, locale)
+			localizedNames = append(localizedNames, localeNames[locale])
+		}
+	}
+
+	_, err := q.Exec(`
+		INSERT INTO geo_names (geoname_id, locale, name)
+		SELECT * FROM UNNEST($1::integer[], $2::text[], $3::text[])
+		ON CONFLICT (geoname_id, locale) DO UPDATE SET name = EXCLUDED.name
+		WHERE geo_names.name <> EXCLUDED.name`,
+		pq.Array(ids), pq.Array(locales), pq.Array(localizedNames))
+	if err != nil {
+		return nil, err
+	}
+	return geoNameIDs, nil
+}
+
+// markGeoNamesStored skips the given IDs from now on. Until then, the names are written again with the next hits, so that a rolled back transaction doesn't leave them out of geo_names for good.
+func markGeoNamesStored(geoNameIDs []uint) {
+	for _, geoNameID := range geoNameIDs {
+		storedGeoNames.Store(geoNameID, struct{}{})
+	}
+}
+
+// GeoNamesCommitted is called once the transaction the hit was resolved in has been committed, so that the localized names recorded for it aren't written again
+func (h *HitInfo) GeoNamesCommitted() {
+	markGeoNamesStored(h.recordedGeoNames)
+	h.recordedGeoNames = nil
+}
+
+// nullGeoNameID maps an unknown (zero) GeoNames ID to a NULL column value
+func nullGeoNameID(geoNameID uint) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: int64(geoNameID),
+		Valid: geoNameID != 0,
+	}
+}
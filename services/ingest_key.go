@@ -0,0 +1,62 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	ErrInvalidIngestKey = errors.New("invalid or revoked ingest key")
+	ErrWebsiteMismatch  = errors.New("hostname doesn't belong to the website of the ingest key")
+)
+
+const (
+	ingestKeyPrefix       = "fck_"
+	ingestKeyRandomBytes  = 24
+	ingestKeyDisplayChars = 12 // how much of the key is kept in clear to tell keys apart
+)
+
+// GenerateIngestKey returns a new random ingest key together with its hash and its display prefix. Only the hash is stored, the key itself is shown once to the user.
+func GenerateIngestKey() (key, hash, prefix string, err error) {
+	randomBytes := make([]byte, ingestKeyRandomBytes)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", "", "", err
+	}
+
+	key = ingestKeyPrefix + hex.EncodeToString(randomBytes)
+	return key, HashIngestKey(key), key[:ingestKeyDisplayChars], nil
+}
+
+func HashIngestKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateIngestKey returns the id of the website the ingest key belongs to, or ErrInvalidIngestKey if the key doesn't exist or has been revoked
+func AuthenticateIngestKey(q Querier, key string) (int, error) {
+	// last_used_at is refreshed at most once a minute, so that a busy backend doesn't turn every hit into a row update
+	query := `
+		WITH ingest_key AS (
+			SELECT id, website_id, last_used_at FROM ingest_keys WHERE key_hash = $1 AND revoked_at IS NULL
+		), touched AS (
+			UPDATE ingest_keys SET last_used_at = NOW()
+			FROM ingest_key
+			WHERE ingest_keys.id = ingest_key.id AND (ingest_key.last_used_at IS NULL OR ingest_key.last_used_at < NOW() - INTERVAL '1 minute')
+		)
+		SELECT website_id FROM ingest_key
+	`
+
+	var websiteID int
+	err := q.QueryRow(query, HashIngestKey(key)).Scan(&websiteID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrInvalidIngestKey
+		}
+		return 0, err
+	}
+
+	return websiteID, nil
+}
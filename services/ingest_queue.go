@@ -0,0 +1,422 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mvavassori/flockcounter/models"
+)
+
+var (
+	ErrQueueFull   = errors.New("ingest queue is full")
+	ErrQueueClosed = errors.New("ingest queue is closed")
+)
+
+// How long an enqueue waits for room in the queue before giving up
+const enqueueTimeout = 100 * time.Millisecond
+
+type IngestQueueConfig struct {
+	QueueSize     int           // capacity of the buffered channel
+	Workers       int           // number of goroutines flushing to Postgres
+	BatchSize     int           // a worker flushes as soon as it holds this many items...
+	FlushInterval time.Duration // ...or when this much time has passed since its last flush
+}
+
+// IngestQueueConfigFromEnv reads the queue configuration from the INGEST_* environment variables, falling back to sensible defaults
+func IngestQueueConfigFromEnv() IngestQueueConfig {
+	config := IngestQueueConfig{
+		QueueSize:     10000,
+		Workers:       4,
+		BatchSize:     500,
+		FlushInterval: 2 * time.Second,
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("INGEST_QUEUE_SIZE")); err == nil && n > 0 {
+		config.QueueSize = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("INGEST_WORKERS")); err == nil && n > 0 {
+		config.Workers = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("INGEST_BATCH_SIZE")); err == nil && n > 0 {
+		config.BatchSize = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("INGEST_FLUSH_INTERVAL")); err == nil && d > 0 {
+		config.FlushInterval = d
+	}
+
+	return config
+}
+
+type IngestQueueStats struct {
+	Depth       int       `json:"depth"`
+	Capacity    int       `json:"capacity"`
+	Workers     int       `json:"workers"`
+	Enqueued    int64     `json:"enqueued"`
+	Rejected    int64     `json:"rejected"` // refused because the queue was full
+	Stored      int64     `json:"stored"`
+	Dropped     int64     `json:"dropped"` // unregistered domains, filtered hits and server-side hits for the wrong website
+	Failed      int64     `json:"failed"`  // lost because of database errors
+	Flushes     int64     `json:"flushes"`
+	LastFlushAt time.Time `json:"lastFlushAt"`
+}
+
+// ingestItem holds either a visit or an event
+type ingestItem struct {
+	visit *PendingVisit
+	event *PendingEvent
+}
+
+// IngestQueue buffers parsed visits and events in memory and writes them to Postgres in bulk from a pool of workers, so that traffic bursts don't translate into one connection per pageview.
+type IngestQueue struct {
+	db     *sql.DB
+	config IngestQueueConfig
+	items  chan ingestItem
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex // guards closed, so nothing is sent on a closed channel
+	closed bool
+
+	enqueued    atomic.Int64
+	rejected    atomic.Int64
+	stored      atomic.Int64
+	dropped     atomic.Int64
+	failed      atomic.Int64
+	flushes     atomic.Int64
+	lastFlushAt atomic.Int64 // unix nano
+}
+
+func NewIngestQueue(db *sql.DB, config IngestQueueConfig) *IngestQueue {
+	return &IngestQueue{
+		db:     db,
+		config: config,
+		items:  make(chan ingestItem, config.QueueSize),
+	}
+}
+
+// Start launches the workers
+func (q *IngestQueue) Start() {
+	for i := 0; i < q.config.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	log.Printf("Ingest queue started (size %d, %d workers, batch size %d, flush interval %s)", q.config.QueueSize, q.config.Workers, q.config.BatchSize, q.config.FlushInterval)
+}
+
+// Close stops accepting new items and blocks until everything already queued has been flushed
+func (q *IngestQueue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.items)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+	log.Println("Ingest queue drained")
+}
+
+func (q *IngestQueue) EnqueueVisit(pending PendingVisit) error {
+	return q.enqueue(ingestItem{visit: &pending})
+}
+
+func (q *IngestQueue) EnqueueEvent(pending PendingEvent) error {
+	return q.enqueue(ingestItem{event: &pending})
+}
+
+// enqueue waits up to enqueueTimeout for room in the queue. Returning ErrQueueFull lets the handlers push back on the client instead of piling up goroutines.
+func (q *IngestQueue) enqueue(item ingestItem) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case q.items <- item:
+		q.enqueued.Add(1)
+		return nil
+	case <-timer.C:
+		q.rejected.Add(1)
+		return ErrQueueFull
+	}
+}
+
+func (q *IngestQueue) Stats() IngestQueueStats {
+	stats := IngestQueueStats{
+		Depth:    len(q.items),
+		Capacity: cap(q.items),
+		Workers:  q.config.Workers,
+		Enqueued: q.enqueued.Load(),
+		Rejected: q.rejected.Load(),
+		Stored:   q.stored.Load(),
+		Dropped:  q.dropped.Load(),
+		Failed:   q.failed.Load(),
+		Flushes:  q.flushes.Load(),
+	}
+	if last := q.lastFlushAt.Load(); last > 0 {
+		stats.LastFlushAt = time.Unix(0, last)
+	}
+	return stats
+}
+
+func (q *IngestQueue) worker() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(q.config.FlushInterval)
+	defer ticker.Stop()
+
+	buffer := make([]ingestItem, 0, q.config.BatchSize)
+	for {
+		select {
+		case item, ok := <-q.items:
+			if !ok {
+				// The queue has been closed, flush whatever is left and exit
+				q.flush(buffer)
+				return
+			}
+			buffer = append(buffer, item)
+			if len(buffer) >= q.config.BatchSize {
+				q.flush(buffer)
+				buffer = buffer[:0]
+			}
+		case <-ticker.C:
+			q.flush(buffer)
+			buffer = buffer[:0]
+		}
+	}
+}
+
+// websiteLookup caches the result of a website lookup for the duration of a flush
+type websiteLookup struct {
+	website ingestWebsite
+	err     error
+}
+
+// A failed flush is retried this many times in all, waiting flushRetryBackoff before the first retry and twice as long before each following one
+const (
+	flushAttempts     = 3
+	flushRetryBackoff = 500 * time.Millisecond
+)
+
+// flush resolves and stores the buffered items, in a single transaction unless Postgres keeps refusing it (see storeBatch)
+func (q *IngestQueue) flush(items []ingestItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	q.storeBatch(items, flushAttempts)
+	q.flushes.Add(1)
+	q.lastFlushAt.Store(time.Now().UnixNano())
+}
+
+// storeBatch stores the items, retrying failed transactions with backoff. If Postgres keeps rejecting the batch, it is split in halves (stored without further retries) until the items it can't take are isolated, so that a single bad hit doesn't take the whole batch down with it.
+func (q *IngestQueue) storeBatch(items []ingestItem, attempts int) {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(flushRetryBackoff << (attempt - 1))
+		}
+
+		var stored, dropped int
+		stored, dropped, err = q.store(items)
+		if err == nil {
+			q.stored.Add(int64(stored))
+			q.dropped.Add(int64(dropped))
+			return
+		}
+	}
+
+	// Splitting only helps when Postgres refused the data, not when it can't be reached
+	var pqErr *pq.Error
+	if len(items) == 1 || !errors.As(err, &pqErr) {
+		log.Printf("Error flushing %d ingest items: %v", len(items), err)
+		q.failed.Add(int64(len(items)))
+		return
+	}
+
+	log.Printf("Error flushing %d ingest items, splitting the batch: %v", len(items), err)
+	middle := len(items) / 2
+	q.storeBatch(items[:middle], 1)
+	q.storeBatch(items[middle:], 1)
+}
+
+func (q *IngestQueue) store(items []ingestItem) (int, int, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback() // no-op once the transaction has been committed
+
+	websites := make(map[string]websiteLookup) // hostname -> website
+
+	var resolved []ingestItem
+	var identifiers []string
+	filtered := make(map[int]map[string]int) // website id -> reason -> count
+	geoNames := make(map[uint]map[string]string)
+	dropped := 0
+
+	for _, item := range items {
+		// Work on copies, so that the items are resolved from scratch if the batch is stored again after a failure
+		var hit HitInfo
+		if item.visit != nil {
+			visit := *item.visit
+			item.visit = &visit
+			hit = visit.HitInfo
+		} else {
+			event := *item.event
+			item.event = &event
+			hit = event.HitInfo
+		}
+
+		lookup, ok := websites[hit.Domain]
+		if !ok {
+			lookup.website, lookup.err = lookupWebsite(tx, hit.Domain)
+			websites[hit.Domain] = lookup
+		}
+
+		if lookup.err != nil {
+			if errors.Is(lookup.err, ErrUnregisteredDomain) {
+				dropped++
+				continue
+			}
+			return 0, 0, lookup.err
+		}
+		website := lookup.website
+
+		if err := checkIngestKeyWebsite(website, hit); err != nil {
+			log.Printf("Dropping server-side hit from %s: %v", hit.Domain, err)
+			dropped++
+			continue
+		}
+
+		var pathname string
+		if item.visit != nil {
+			pathname = normalizePathname(website, pagePathname(website, item.visit.Visit.URL, item.visit.Visit.Pathname))
+		} else {
+			pathname = normalizePathname(website, pagePathname(website, item.event.Event.URL, item.event.Event.Pathname))
+		}
+
+		if reason := filterReason(website, hit, pathname); reason != "" {
+			if filtered[website.ID] == nil {
+				filtered[website.ID] = make(map[string]int)
+			}
+			filtered[website.ID][reason]++
+			dropped++
+			continue
+		}
+
+		if item.visit != nil {
+			item.visit.Visit.WebsiteID = website.ID
+			item.visit.Visit.WebsiteDomain = website.Domain
+			item.visit.Visit.Pathname = pathname
+		} else {
+			item.event.Event.WebsiteID = int64(website.ID)
+			item.event.Event.WebsiteDomain = website.Domain
+			item.event.Event.Pathname = pathname
+		}
+
+		identifier, err := visitorIdentifier(website.Domain, hit.IPAddress, hit.UserAgent)
+		if err != nil {
+			return 0, 0, err
+		}
+		if item.visit != nil {
+			item.visit.Visit.VisitorID = identifier
+		} else {
+			item.event.Event.VisitorID = identifier
+		}
+		identifiers = append(identifiers, identifier)
+		resolved = append(resolved, item)
+
+		for geoNameID, names := range hit.GeoNames {
+			geoNames[geoNameID] = names
+		}
+	}
+
+	recordedGeoNames, err := recordGeoNames(tx, geoNames)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for websiteID, reasons := range filtered {
+		for reason, count := range reasons {
+			if err := recordFilteredHits(tx, websiteID, reason, count); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	// Items are processed in arrival order so the first hit of a visitor is the one marked as unique, like on the synchronous path
+	isUnique, err := markUniqueVisitors(tx, identifiers)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The session locks of all the visitors of the batch are taken up front, in an order every flush agrees on
+	var sessionVisits []models.VisitInsert
+	for _, item := range resolved {
+		if item.visit != nil {
+			sessionVisits = append(sessionVisits, item.visit.Visit)
+		}
+	}
+	if err := lockSessions(tx, sessionVisits); err != nil {
+		return 0, 0, err
+	}
+
+	var visits []models.VisitInsert
+	var events []models.EventInsert
+	mergedSessions := make(map[int64]int64) // session merged by assignSession -> session it was merged into
+	for i, item := range resolved {
+		if item.visit != nil {
+			item.visit.Visit.IsUnique = isUnique[i]
+			absorbed, err := assignSession(tx, &item.visit.Visit)
+			if err != nil {
+				return 0, 0, err
+			}
+			for _, sessionID := range absorbed {
+				mergedSessions[sessionID] = item.visit.Visit.SessionID
+			}
+			visits = append(visits, item.visit.Visit)
+		} else {
+			item.event.Event.IsUnique = isUnique[i]
+			events = append(events, item.event.Event)
+		}
+	}
+
+	// Visits of the batch assigned to a session that a later visit merged into another one follow it
+	for i := range visits {
+		for {
+			sessionID, merged := mergedSessions[visits[i].SessionID]
+			if !merged {
+				break
+			}
+			visits[i].SessionID = sessionID
+		}
+	}
+
+	if err := InsertVisits(tx, visits); err != nil {
+		return 0, 0, err
+	}
+	if err := InsertEvents(tx, events); err != nil {
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	markGeoNamesStored(recordedGeoNames)
+
+	return len(resolved), dropped, nil
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx, so the ingest helpers can run on their own or inside a transaction (e.g. batch ingestion).
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var (
+	ErrUnregisteredDomain = errors.New("website not registered")
+	ErrInvalidURL         = errors.New("invalid URL format")
+	ErrInvalidReferrer    = errors.New("invalid referrer format")
+	ErrFiltered           = errors.New("hit filtered") // wrapped together with the filter reason
+	ErrInvalidProperties  = errors.New("invalid event properties")
+	ErrMissingUserAgent   = errors.New("userAgent is required for server-side hits")
+)
+
+// Reasons stored in the filtered_hits table
+const (
+	FilterReasonBot          = "bot"
+	FilterReasonReferrerSpam = "referrer_spam"
+	FilterReasonExcluded     = "excluded"   // matched an exclusion rule of the website
+	FilterReasonDatacenter   = "datacenter" // came from a cloud or hosting network and the website excludes them
+)
+
+// HitInfo holds what the ingest pipeline needs to know about a visit or an event besides the row that ends up in the database
+type HitInfo struct {
+	Domain       string // hostname the hit was sent from
+	IPAddress    string
+	UserAgent    string
+	IsBot        bool
+	IsDatacenter bool   // the visitor ip belongs to a cloud, hosting or datacenter network
+	WebsiteID    int    // website of the ingest key for server-side hits, 0 for browser hits
+	Referrer     string // normalized referrer (host and path), "Direct" if there is none
+	ReferrerHost string
+	GeoNames     map[uint]map[string]string // localized names of the visitor location by GeoNames ID and locale, stored in geo_names
+
+	recordedGeoNames []uint // GeoNames IDs written to geo_names when resolving the hit, see GeoNamesCommitted
+}
+
+// ingestWebsite is the part of a websites row that ingestion cares about
+type ingestWebsite struct {
+	ID                 int
+	Domain             string
+	KeepBots           bool
+	ReferrerRules      []models.ReferrerRule
+	ReferrerRegexes    []*regexp.Regexp // compiled pattern of each referrer rule, nil if it isn't a regex rule
+	LowercasePaths     bool
+	StripTrailingSlash bool
+	CollapseIndex      bool
+	HashRouting        bool
+	ExcludeDatacenter  bool
+	PathnameRewrites   []models.PathnameRewrite
+	RewriteRegexes     []*regexp.Regexp // compiled pattern of each pathname rewrite
+	ExclusionRules     []models.ExclusionRule
+	ExclusionRegexes   []*regexp.Regexp // compiled pattern of each exclusion rule, nil if it isn't a pathname rule
+}
+
+// matchingWebsiteQuery selects the id of the website accepting the hostname $1, $2 being its alternative www. form. A wildcard alias stored as *.example.com matches any hostname ending in .example.com, but not example.com itself.
+const matchingWebsiteQuery = `
+	SELECT id
+	FROM (
+		SELECT id, (CASE WHEN domain = $1 THEN 1 ELSE 2 END) AS priority, 0 AS specificity
+		FROM websites
+		WHERE domain = $1 OR domain = $2
+		UNION ALL
+		SELECT website_id AS id, (CASE WHEN hostname = $1 THEN 3 ELSE 4 END) AS priority, LENGTH(hostname) AS specificity
+		FROM website_hostnames
+		WHERE hostname = $1
+			OR (hostname LIKE '*.%' AND RIGHT($1, LENGTH(hostname) - 1) = SUBSTRING(hostname FROM 2))
+	) AS matches
+	ORDER BY priority, specificity DESC
+	LIMIT 1
+`
+
+// alternativeDomain returns the www. counterpart of the hostname, adding or removing the prefix
+func alternativeDomain(hostname string) string {
+	if strings.HasPrefix(hostname, "www.") {
+		return strings.TrimPrefix(hostname, "www.")
+	}
+	return "www." + hostname
+}
+
+// WebsiteIDForHostname returns the id of the website accepting the given hostname, matching it the same way as the ingest pipeline does, or ErrUnregisteredDomain if there is none. It only reads the id, e.g. for the per website rate limit.
+func WebsiteIDForHostname(q Querier, hostname string) (int, error) {
+	var websiteID int
+	err := q.QueryRow(matchingWebsiteQuery, hostname, alternativeDomain(hostname)).Scan(&websiteID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUnregisteredDomain
+		}
+		return 0, err
+	}
+	return websiteID, nil
+}
+
+// lookupWebsite returns the website accepting the given hostname. The registered domain (or its www. counterpart) wins, then an exact alias from website_hostnames, then the most specific wildcard alias (e.g. *.example.com).
+func lookupWebsite(q Querier, hostname string) (ingestWebsite, error) {
+	query := `
+		SELECT websites.id, websites.domain, websites.keep_bots, websites.lowercase_paths, websites.strip_trailing_slash, websites.collapse_index, websites.hash_routing, websites.exclude_datacenter,
+			ARRAY(SELECT rule_type FROM referrer_block_rules WHERE website_id = websites.id ORDER BY id),
+			ARRAY(SELECT pattern FROM referrer_block_rules WHERE website_id = websites.id ORDER BY id),
+			ARRAY(SELECT pattern FROM pathname_rewrite_rules WHERE website_id = websites.id ORDER BY position, id),
+			ARRAY(SELECT replacement FROM pathname_rewrite_rules WHERE website_id = websites.id ORDER BY position, id),
+			ARRAY(SELECT id FROM exclusion_rules WHERE website_id = websites.id ORDER BY id),
+			ARRAY(SELECT rule_type FROM exclusion_rules WHERE website_id = websites.id ORDER BY id),
+			ARRAY(SELECT pattern FROM exclusion_rules WHERE website_id = websites.id ORDER BY id)
+		FROM (` + matchingWebsiteQuery + `) AS website
+		JOIN websites ON websites.id = website.id
+	`
+
+	var website ingestWebsite // website.Domain stores the domain as it is registered in the db
+	var ruleTypes, rulePatterns, rewritePatterns, rewriteReplacements, exclusionTypes, exclusionPatterns []string
+	var exclusionIDs []int64
+	err := q.QueryRow(query, hostname, alternativeDomain(hostname)).Scan(
+		&website.ID, &website.Domain, &website.KeepBots, &website.LowercasePaths, &website.StripTrailingSlash, &website.CollapseIndex, &website.HashRouting, &website.ExcludeDatacenter,
+		pq.Array(&ruleTypes), pq.Array(&rulePatterns), pq.Array(&rewritePatterns), pq.Array(&rewriteReplacements),
+		pq.Array(&exclusionIDs), pq.Array(&exclusionTypes), pq.Array(&exclusionPatterns),
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("Ignoring hit from unregistered hostname %s", hostname)
+			return ingestWebsite{}, ErrUnregisteredDomain
+		}
+		return ingestWebsite{}, err
+	}
+
+	// Regex rules are compiled once per lookup, so a flush of the ingest queue compiles them once for all the hits of the website
+	for i := range ruleTypes {
+		rule := models.ReferrerRule{Type: ruleTypes[i], Pattern: rulePatterns[i]}
+		var compiled *regexp.Regexp
+		if rule.Type == models.ReferrerRuleRegex {
+			compiled = compileRule("referrer rule", rule.Pattern)
+		}
+		website.ReferrerRules = append(website.ReferrerRules, rule)
+		website.ReferrerRegexes = append(website.ReferrerRegexes, compiled)
+	}
+	for i := range rewritePatterns {
+		rewrite := models.PathnameRewrite{Pattern: rewritePatterns[i], Replacement: rewriteReplacements[i]}
+		website.PathnameRewrites = append(website.PathnameRewrites, rewrite)
+		website.RewriteRegexes = append(website.RewriteRegexes, compileRule("pathname rewrite", rewrite.Pattern))
+	}
+	for i := range exclusionIDs {
+		rule := models.ExclusionRule{ID: int(exclusionIDs[i]), WebsiteID: website.ID, Type: exclusionTypes[i], Pattern: exclusionPatterns[i]}
+		var compiled *regexp.Regexp
+		if rule.Type == models.ExclusionRulePathname {
+			compiled = compileRule("pathname exclusion", globRegex(rule.Pattern))
+		}
+		website.ExclusionRules = append(website.ExclusionRules, rule)
+		website.ExclusionRegexes = append(website.ExclusionRegexes, compiled)
+	}
+
+	return website, nil
+}
+
+// checkIngestKeyWebsite makes sure a server-side hit is only stored for the website its ingest key belongs to
+func checkIngestKeyWebsite(website ingestWebsite, hit HitInfo) error {
+	if hit.WebsiteID != 0 && hit.WebsiteID != website.ID {
+		return ErrWebsiteMismatch
+	}
+	return nil
+}
+
+// filterReason returns why a hit should be discarded for the given website, or an empty string if it has to be stored. pathname is the normalized pathname of the hit.
+func filterReason(website ingestWebsite, hit HitInfo, pathname string) string {
+	if hit.IsBot && !website.KeepBots {
+		return FilterReasonBot
+	}
+	if hit.IsDatacenter && website.ExcludeDatacenter {
+		return FilterReasonDatacenter
+	}
+	if isReferrerSpam(website, hit) {
+		return FilterReasonReferrerSpam
+	}
+	if matchExclusionRule(website, net.IP(hit.IPAddress), hit.Domain, pathname) != nil {
+		return FilterReasonExcluded
+	}
+	return ""
+}
+
+// compileRule compiles the pattern of a regex rule (referrer block rule, pathname rewrite or pathname exclusion). Rules are validated when they are created so a pattern that doesn't compile is just logged and skipped, compileRule returns nil for it.
+func compileRule(kind, pattern string) *regexp.Regexp {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("Skipping invalid %s %q: %v", kind, pattern, err)
+		return nil
+	}
+	return compiled
+}
+
+// isReferrerSpam checks the referrer against the bundled spam list and the block rules of the website. Exact and suffix rules match the referrer host, regex rules the whole referrer (host and path).
+func isReferrerSpam(website ingestWebsite, hit HitInfo) bool {
+	if hit.ReferrerHost == "" {
+		return false
+	}
+
+	if utils.IsReferrerSpam(hit.ReferrerHost) {
+		return true
+	}
+
+	host := strings.ToLower(hit.ReferrerHost)
+	for i, rule := range website.ReferrerRules {
+		switch rule.Type {
+		case models.ReferrerRuleExact:
+			if host == rule.Pattern {
+				return true
+			}
+		case models.ReferrerRuleSuffix:
+			if host == rule.Pattern || strings.HasSuffix(host, "."+rule.Pattern) {
+				return true
+			}
+		case models.ReferrerRuleRegex:
+			if compiled := website.ReferrerRegexes[i]; compiled != nil && compiled.MatchString(hit.Referrer) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// applyFilters records the hit in the filtered_hits counters and returns an error wrapping ErrFiltered if the website doesn't want it stored
+func applyFilters(q Querier, website ingestWebsite, hit HitInfo, pathname string) error {
+	reason := filterReason(website, hit, pathname)
+	if reason == "" {
+		return nil
+	}
+
+	if err := recordFilteredHits(q, website.ID, reason, 1); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", ErrFiltered, reason)
+}
+
+// recordFilteredHits increments the daily counter of discarded hits of a website
+func recordFilteredHits(q Querier, websiteID int, reason string, count int) error {
+	_, err := q.Exec(`
+		INSERT INTO filtered_hits (website_id, date, reason, count)
+		VALUES ($1, CURRENT_DATE, $2, $3)
+		ON CONFLICT (website_id, date, reason) DO UPDATE SET count = filtered_hits.count + EXCLUDED.count
+	`, websiteID, reason, count)
+	return err
+}
+
+// normalizeReferrer strips the protocol and query string from the referrer and returns it along with its host. An empty referrer (or the "Direct" placeholder sent by the tracker script) is stored as "Direct", with no host.
+func normalizeReferrer(pageURL *url.URL, referrer string) (string, string, error) {
+	if referrer == "" || referrer == "Direct" {
+		return "Direct", "", nil
+	}
+
+	// Parsed relative to the page url so that relative referrers keep resolving like they always did
+	referrerURL, err := pageURL.Parse(referrer)
+	if err != nil {
+		return "", "", ErrInvalidReferrer
+	}
+
+	return referrerURL.Host + referrerURL.Path, referrerURL.Hostname(), nil
+}
+
+// visitorIdentifier returns the daily hashed identifier of a visitor on a website
+func visitorIdentifier(websiteDomain, ipAddress, userAgent string) (string, error) {
+	// Generate daily salt or grab from cache if already generated
+	dailySalt, err := utils.GenerateDailySalt()
+	if err != nil {
+		return "", err
+	}
+
+	return utils.GenerateUniqueIdentifier(dailySalt, websiteDomain, ipAddress, userAgent)
+}
+
+// checkUniqueVisitor reports whether this is the first hit of the day for the visitor identifier (see visitorIdentifier) and records the identifier if so.
+func checkUniqueVisitor(q Querier, uniqueIdentifier string) (bool, error) {
+	var exists bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM daily_unique_identifiers WHERE unique_identifier = $1)", uniqueIdentifier).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	_, err = q.Exec("INSERT INTO daily_unique_identifiers (unique_identifier) VALUES ($1)", uniqueIdentifier)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// markUniqueVisitors is the bulk version of checkUniqueVisitor. For every identifier it reports whether it is the first time it is seen today, taking into account both the identifiers already stored and earlier occurrences in the same slice, then records the new ones.
+func markUniqueVisitors(q Querier, identifiers []string) ([]bool, error) {
+	isUnique := make([]bool, len(identifiers))
+	if len(identifiers) == 0 {
+		return isUnique, nil
+	}
+
+	rows, err := q.Query("SELECT unique_identifier FROM daily_unique_identifiers WHERE unique_identifier = ANY($1)", pq.Array(identifiers))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var identifier string
+		if err := rows.Scan(&identifier); err != nil {
+			return nil, err
+		}
+		seen[identifier] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var newIdentifiers [][]interface{}
+	for i, identifier := range identifiers {
+		if seen[identifier] {
+			continue
+		}
+		seen[identifier] = true
+		isUnique[i] = true
+		newIdentifiers = append(newIdentifiers, []interface{}{identifier})
+	}
+
+	err = bulkInsert(q, "daily_unique_identifiers", []string{"unique_identifier"}, newIdentifiers)
+	if err != nil {
+		return nil, err
+	}
+
+	return isUnique, nil
+}
+
+// Postgres doesn't accept more than 65535 parameters in a single statement
+const maxQueryParams = 65535
+
+// bulkInsert inserts the given rows with as few multi-row INSERT statements as possible
+func bulkInsert(q Querier, table string, columns []string, rows [][]interface{}) error {
+	rowsPerStatement := maxQueryParams / len(columns)
+
+	for start := 0; start < len(rows); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var query strings.Builder
+		fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+
+		params := make([]interface{}, 0, (end-start)*len(columns))
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			placeholders := make([]string, len(row))
+			for j, value := range row {
+				params = append(params, value)
+				placeholders[j] = fmt.Sprintf("$%d", len(params))
+			}
+			query.WriteString("(" + strings.Join(placeholders, ", ") + ")")
+		}
+
+		if _, err := q.Exec(query.String(), params...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nullString maps an empty string to a NULL column value
+func nullString(s string) sql.NullString {
+	return sql.NullString{
+		String: s,
+		Valid:  s != "",
+	}
+}
+
+// nullASN maps an unknown (zero) autonomous system number to a NULL column value
+func nullASN(asn uint) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: int64(asn),
+		Valid: asn != 0,
+	}
+}
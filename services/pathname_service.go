@@ -0,0 +1,192 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// pagePathname returns the path of the page the hit was sent from. For websites using hash routing it's the route in the url fragment (#/path or #!/path) rather than the pathname sent by the tracker, plain anchors like #pricing are ignored.
+func pagePathname(website ingestWebsite, rawURL, pathname string) string {
+	if !website.HashRouting {
+		return pathname
+	}
+
+	_, fragment, found := strings.Cut(rawURL, "#")
+	if !found {
+		return pathname
+	}
+	fragment = strings.TrimPrefix(fragment, "!")
+	if !strings.HasPrefix(fragment, "/") {
+		return pathname
+	}
+	if end := strings.IndexAny(fragment, "?#"); end >= 0 {
+		fragment = fragment[:end]
+	}
+	return fragment
+}
+
+// normalizePathname applies the pathname settings of the website (lowercasing, index.html collapsing, trailing slash stripping, in this order) and then its rewrite rules
+func normalizePathname(website ingestWebsite, pathname string) string {
+	if website.LowercasePaths {
+		pathname = strings.ToLower(pathname)
+	}
+
+	if website.CollapseIndex {
+		for _, index := range []string{"index.html", "index.htm"} {
+			if len(pathname) >= len(index)+1 && strings.EqualFold(pathname[len(pathname)-len(index)-1:], "/"+index) {
+				pathname = pathname[:len(pathname)-len(index)]
+				break
+			}
+		}
+	}
+
+	if website.StripTrailingSlash && len(pathname) > 1 {
+		pathname = strings.TrimRight(pathname, "/")
+		if pathname == "" {
+			pathname = "/"
+		}
+	}
+
+	for i, rewrite := range website.PathnameRewrites {
+		if compiled := website.RewriteRegexes[i]; compiled != nil {
+			pathname = compiled.ReplaceAllString(pathname, rewrite.Replacement)
+		}
+	}
+
+	return pathname
+}
+
+// PathnameRewriteResult reports what ReapplyPathnameRules changed
+type PathnameRewriteResult struct {
+	Pathnames int64 `json:"pathnames"` // distinct pathnames that changed
+	Visits    int64 `json:"visits"`
+	Events    int64 `json:"events"`
+}
+
+// ReapplyPathnameRules normalizes the pathnames already stored for a website, and the entry and exit pages of its sessions, with its current settings (hash routing included) and rewrite rules. The raw pathnames are not kept, so the rules are applied to the stored (possibly already normalized) values: new rules take effect on the history, but removing a rule doesn't bring the original pathnames back.
+func ReapplyPathnameRules(db *sql.DB, domain string) (PathnameRewriteResult, error) {
+	var result PathnameRewriteResult
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback() // no-op once the transaction has been committed
+
+	website, err := lookupWebsite(tx, domain)
+	if err != nil {
+		return result, err
+	}
+
+	// With hash routing the route is read back from the stored url, with pagePathname so that urls are split the same way as at ingest
+	if website.HashRouting {
+		if err := reapplyHashRoutes(tx, website); err != nil {
+			return result, err
+		}
+	}
+
+	// Every pathname is read before updating anything, a transaction can't run other statements while rows are being read
+	rows, err := tx.Query(`
+		SELECT pathname FROM visits WHERE website_id = $1
+		UNION
+		SELECT pathname FROM events WHERE website_id = $1
+	`, website.ID)
+	if err != nil {
+		return result, err
+	}
+
+	rewrites := make(map[string]string) // stored pathname -> normalized pathname
+	for rows.Next() {
+		var pathname string
+		if err := rows.Scan(&pathname); err != nil {
+			rows.Close()
+			return result, err
+		}
+		if normalized := normalizePathname(website, pathname); normalized != pathname {
+			rewrites[pathname] = normalized
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for pathname, normalized := range rewrites {
+		visits, err := tx.Exec("UPDATE visits SET pathname = $3 WHERE website_id = $1 AND pathname = $2", website.ID, pathname, normalized)
+		if err != nil {
+			return result, err
+		}
+		events, err := tx.Exec("UPDATE events SET pathname = $3 WHERE website_id = $1 AND pathname = $2", website.ID, pathname, normalized)
+		if err != nil {
+			return result, err
+		}
+		visitsUpdated, _ := visits.RowsAffected()
+		eventsUpdated, _ := events.RowsAffected()
+		result.Visits += visitsUpdated
+		result.Events += eventsUpdated
+		result.Pathnames++
+	}
+
+	// The entry and exit pages of the sessions are taken again from their visits, they are the pages viewed first and last
+	_, err = tx.Exec(`
+		UPDATE sessions SET entry_page = pages.entry_page, exit_page = pages.exit_page
+		FROM (
+			SELECT session_id,
+				(ARRAY_AGG(pathname ORDER BY timestamp - make_interval(secs => GREATEST(time_spent_on_page, 0) / 1000.0)))[1] AS entry_page,
+				(ARRAY_AGG(pathname ORDER BY timestamp DESC))[1] AS exit_page
+			FROM visits
+			WHERE website_id = $1 AND session_id IS NOT NULL
+			GROUP BY session_id
+		) AS pages
+		WHERE sessions.id = pages.session_id AND (sessions.entry_page <> pages.entry_page OR sessions.exit_page <> pages.exit_page)
+	`, website.ID)
+	if err != nil {
+		return result, err
+	}
+
+	return result, tx.Commit()
+}
+
+// reapplyHashRoutes sets the pathname of the visits and events of a website using hash routing to the route in their url
+func reapplyHashRoutes(tx *sql.Tx, website ingestWebsite) error {
+	for _, table := range []string{"visits", "events"} {
+		rows, err := tx.Query(fmt.Sprintf("SELECT DISTINCT url, pathname FROM %s WHERE website_id = $1 AND url LIKE '%%#%%'", table), website.ID)
+		if err != nil {
+			return err
+		}
+
+		var urls, pathnames, routes []string
+		for rows.Next() {
+			var rawURL, pathname string
+			if err := rows.Scan(&rawURL, &pathname); err != nil {
+				rows.Close()
+				return err
+			}
+			if route := pagePathname(website, rawURL, pathname); route != pathname {
+				urls = append(urls, rawURL)
+				pathnames = append(pathnames, pathname)
+				routes = append(routes, route)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(routes) == 0 {
+			continue
+		}
+
+		_, err = tx.Exec(fmt.Sprintf(`
+			UPDATE %[1]s SET pathname = routes.route
+			FROM UNNEST($2::text[], $3::text[], $4::text[]) AS routes (url, pathname, route)
+			WHERE %[1]s.website_id = $1 AND %[1]s.url = routes.url AND %[1]s.pathname = routes.pathname
+		`, table), website.ID, pq.Array(urls), pq.Array(pathnames), pq.Array(routes))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mvavassori/flockcounter/models"
+)
+
+// How long a visitor can stay inactive before their next pageview starts a new session
+const DefaultSessionTimeout = 30 * time.Minute
+
+var sessionTimeout atomic.Int64 // nanoseconds
+
+func init() {
+	sessionTimeout.Store(int64(DefaultSessionTimeout))
+}
+
+// SetSessionTimeout changes the inactivity timeout used to group pageviews into sessions
+func SetSessionTimeout(timeout time.Duration) {
+	sessionTimeout.Store(int64(timeout))
+}
+
+// SessionTimeoutFromEnv reads the SESSION_TIMEOUT environment variable (e.g. 30m), falling back to DefaultSessionTimeout
+func SessionTimeoutFromEnv() time.Duration {
+	value := os.Getenv("SESSION_TIMEOUT")
+	if value == "" {
+		return DefaultSessionTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		log.Printf("Ignoring SESSION_TIMEOUT %q, using %s", value, DefaultSessionTimeout)
+		return DefaultSessionTimeout
+	}
+	return timeout
+}
+
+// assignSession attaches the visit to the session of its visitor, starting a new one if the visitor has been inactive for longer than the session timeout. The tracker sends a visit when the visitor leaves the page, so the page was viewed from Timestamp minus TimeSpentOnPage (milliseconds) to Timestamp.
+// A late pageview can bridge the gap between two sessions of the visitor, they are then merged into the earliest one: the visits of the others are moved to it and their ids are returned, so that visits not inserted yet can be moved too.
+// q must be a transaction: the session lock of the visitor it takes is held until the transaction ends, so that the visit can be inserted before another pageview of the visitor looks for its session.
+func assignSession(q Querier, visit *models.VisitInsert) ([]int64, error) {
+	viewEnd := visit.Timestamp
+	viewStart := viewEnd.Add(-time.Duration(max(visit.TimeSpentOnPage, 0)) * time.Millisecond)
+	timeout := time.Duration(sessionTimeout.Load()).Seconds()
+
+	// A row lock can't serialize the first pageviews of a visitor, when there is no session row to lock yet, so the pageviews of a visitor take an advisory lock instead. Two of them arriving at the same time would otherwise both start a session.
+	if _, err := q.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))", visit.WebsiteID, visit.VisitorID); err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(`
+		SELECT id, started_at, last_seen_at, entry_page, exit_page, pageviews FROM sessions
+		WHERE website_id = $1 AND visitor_id = $2
+			AND $3::timestamptz <= last_seen_at + make_interval(secs => $5::double precision)
+			AND $4::timestamptz >= started_at - make_interval(secs => $5::double precision)
+		ORDER BY started_at, id
+	`, visit.WebsiteID, visit.VisitorID, viewStart, viewEnd, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type sessionRow struct {
+		id         int64
+		startedAt  time.Time
+		lastSeenAt time.Time
+		entryPage  string
+		exitPage   string
+		pageviews  int
+	}
+	var sessions []sessionRow
+	for rows.Next() {
+		var session sessionRow
+		if err := rows.Scan(&session.id, &session.startedAt, &session.lastSeenAt, &session.entryPage, &session.exitPage, &session.pageviews); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(sessions) == 0 {
+		err := q.QueryRow(`
+			INSERT INTO sessions (website_id, website_domain, visitor_id, started_at, last_seen_at, entry_page, exit_page, pageviews, duration)
+			VALUES ($1, $2, $3, $4, $5, $6, $6, 1, $7)
+			RETURNING id
+		`, visit.WebsiteID, visit.WebsiteDomain, visit.VisitorID, viewStart, viewEnd, visit.Pathname, int(viewEnd.Sub(viewStart).Seconds())).Scan(&visit.SessionID)
+		return nil, err
+	}
+
+	// The pageview is the entry page only if it started strictly before the session, and the exit page unless the session ended after it
+	merged := sessionRow{id: sessions[0].id, startedAt: viewStart, lastSeenAt: viewEnd, entryPage: visit.Pathname, exitPage: visit.Pathname, pageviews: 1}
+	var absorbed []int64
+	for i, session := range sessions {
+		if i > 0 {
+			absorbed = append(absorbed, session.id)
+		}
+		merged.pageviews += session.pageviews
+		if !session.startedAt.After(merged.startedAt) {
+			merged.startedAt = session.startedAt
+			merged.entryPage = session.entryPage
+		}
+		if session.lastSeenAt.After(merged.lastSeenAt) {
+			merged.lastSeenAt = session.lastSeenAt
+			merged.exitPage = session.exitPage
+		}
+	}
+
+	_, err = q.Exec(`
+		UPDATE sessions SET started_at = $2, last_seen_at = $3, entry_page = $4, exit_page = $5, pageviews = $6, duration = $7
+		WHERE id = $1
+	`, merged.id, merged.startedAt, merged.lastSeenAt, merged.entryPage, merged.exitPage, merged.pageviews, int(merged.lastSeenAt.Sub(merged.startedAt).Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(absorbed) > 0 {
+		if _, err := q.Exec("UPDATE visits SET session_id = $1 WHERE session_id = ANY($2)", merged.id, pq.Array(absorbed)); err != nil {
+			return nil, err
+		}
+		if _, err := q.Exec("DELETE FROM sessions WHERE id = ANY($1)", pq.Array(absorbed)); err != nil {
+			return nil, err
+		}
+	}
+
+	visit.SessionID = merged.id
+	return absorbed, nil
+}
+
+// lockSessions takes the session locks of the visitors of several visits at once (see assignSession), always in the same order so that concurrent transactions can't deadlock on them
+func lockSessions(q Querier, visits []models.VisitInsert) error {
+	websiteIDs := make([]int64, len(visits))
+	visitorIDs := make([]string, len(visits))
+	for i, visit := range visits {
+		websiteIDs[i] = int64(visit.WebsiteID)
+		visitorIDs[i] = visit.VisitorID
+	}
+
+	_, err := q.Exec(`
+		SELECT pg_advisory_xact_lock(website_id, visitor_key)
+		FROM (
+			SELECT DISTINCT website_id, hashtext(visitor_id) AS visitor_key
+			FROM UNNEST($1::integer[], $2::text[]) AS visitors (website_id, visitor_id)
+			ORDER BY website_id, visitor_key
+		) AS locks`,
+		pq.Array(websiteIDs), pq.Array(visitorIDs))
+	return err
+}
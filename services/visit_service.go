@@ -0,0 +1,215 @@
+package services
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mileusna/useragent"
+	"github.com/mvavassori/flockcounter/models"
+	"github.com/mvavassori/flockcounter/utils"
+)
+
+// PendingVisit is a visit that has been parsed from the tracker payload but not yet matched to a website or stored
+type PendingVisit struct {
+	HitInfo
+	Visit models.VisitInsert
+}
+
+// BuildVisit parses a tracker payload into a PendingVisit, locating the visitor with the ip and the request headers the geolocator may read (nil if none can be trusted). clientHints refine the browser and the operating system of the user agent, they are empty for server-side visits. It doesn't touch Postgres, everything that needs the database is done by ResolveVisit. serverSide is set for visits sent by a backend with an ingest key, which don't go through the tracker script and must name the user agent of the visitor.
+func BuildVisit(geolocator utils.Geolocator, ip net.IP, locationHeader http.Header, clientHints utils.ClientHints, visitReceiver models.VisitReceiver, serverSide bool) (PendingVisit, error) {
+	// A missing user agent marks a browser hit as a bot, a backend forgetting to pass it along would have all its hits silently filtered
+	if serverSide && strings.TrimSpace(visitReceiver.UserAgent) == "" {
+		return PendingVisit{}, ErrMissingUserAgent
+	}
+
+	location := geolocator.Locate(ip, locationHeader)
+
+	ua := useragent.Parse(visitReceiver.UserAgent)
+	device := utils.DetectDevice(&ua, clientHints)
+
+	pageURL, err := url.Parse(visitReceiver.URL)
+	if err != nil {
+		return PendingVisit{}, ErrInvalidURL
+	}
+
+	referrer, referrerHost, err := normalizeReferrer(pageURL, visitReceiver.Referrer)
+	if err != nil {
+		return PendingVisit{}, err
+	}
+
+	referrerSource, _ := utils.ReferrerSource(referrerHost)
+
+	query := pageURL.Query()
+
+	// A real browser spends some time on the page before the tracker sends the visit, a zero (or negative) duration with no referrer is a made up payload. Backends usually send the pageview as soon as it is served, so the check doesn't apply to them.
+	fakePayload := !serverSide && (visitReceiver.TimeSpentOnPage < 0 || (visitReceiver.TimeSpentOnPage == 0 && referrer == "Direct"))
+
+	return PendingVisit{
+		Visit: models.VisitInsert{
+			Timestamp:       visitReceiver.Timestamp,
+			Referrer:        referrer,
+			ReferrerSource:  referrerSource,
+			URL:             visitReceiver.URL,
+			Hostname:        pageURL.Hostname(),
+			Pathname:        visitReceiver.Pathname,
+			DeviceType:      device.Type,
+			OS:              device.OS,
+			OSVersion:       device.OSVersion,
+			Browser:         device.Browser,
+			BrowserVersion:  device.BrowserVersion,
+			ScreenSize:      utils.ScreenSize(visitReceiver.ScreenWidth),
+			Language:        visitReceiver.Language,
+			Country:         location.Country,
+			Region:          location.Region,
+			City:            location.City,
+			CountryCode:     location.CountryCode,
+			RegionCode:      location.RegionCode,
+			Continent:       location.Continent,
+			CountryID:       location.CountryID,
+			RegionID:        location.RegionID,
+			CityID:          location.CityID,
+			ASN:             location.ASN,
+			ASNOrg:          location.ASNOrganization,
+			IsDatacenter:    location.Datacenter,
+			TimeSpentOnPage: visitReceiver.TimeSpentOnPage,
+			UTMSource:       nullString(query.Get("utm_source")),
+			UTMMedium:       nullString(query.Get("utm_medium")),
+			UTMCampaign:     nullString(query.Get("utm_campaign")),
+			UTMTerm:         nullString(query.Get("utm_term")),
+			UTMContent:      nullString(query.Get("utm_content")),
+			Channel:         utils.ClassifyChannel(referrerHost, pageURL.Hostname(), query.Get("utm_source"), query.Get("utm_medium"), query.Get("utm_campaign")),
+			ScrollDepth:     scrollDepth(visitReceiver.ScrollDepth),
+			WebVitals:       visitReceiver.WebVitals.Sanitized(),
+		},
+		HitInfo: HitInfo{
+			Domain:       pageURL.Hostname(),
+			IPAddress:    string(ip),
+			UserAgent:    visitReceiver.UserAgent,
+			IsBot:        utils.IsBot(&ua) || fakePayload,
+			Referrer:     referrer,
+			ReferrerHost: referrerHost,
+			IsDatacenter: location.Datacenter,
+			GeoNames:     location.Names,
+		},
+	}, nil
+}
+
+// ResolveVisit looks up the website the visit belongs to, applies the website filters and pathname rules, works out whether the visitor is unique for the day and assigns the visit to a session. It returns ErrUnregisteredDomain if no website accepts the hostname, ErrWebsiteMismatch if a server-side visit names a hostname of another website, and an error wrapping ErrFiltered if the visit must be discarded.
+func ResolveVisit(q Querier, pending *PendingVisit) error {
+	website, err := lookupWebsite(q, pending.Domain)
+	if err != nil {
+		return err
+	}
+
+	if err := checkIngestKeyWebsite(website, pending.HitInfo); err != nil {
+		return err
+	}
+
+	pathname := normalizePathname(website, pagePathname(website, pending.Visit.URL, pending.Visit.Pathname))
+
+	if err := applyFilters(q, website, pending.HitInfo, pathname); err != nil {
+		return err
+	}
+
+	recordedGeoNames, err := recordGeoNames(q, pending.GeoNames)
+	if err != nil {
+		return err
+	}
+	pending.recordedGeoNames = recordedGeoNames
+
+	identifier, err := visitorIdentifier(website.Domain, pending.IPAddress, pending.UserAgent)
+	if err != nil {
+		return err
+	}
+
+	isUnique, err := checkUniqueVisitor(q, identifier)
+	if err != nil {
+		return err
+	}
+
+	pending.Visit.WebsiteID = website.ID
+	pending.Visit.WebsiteDomain = website.Domain
+	pending.Visit.Pathname = pathname
+	pending.Visit.IsUnique = isUnique
+	pending.Visit.VisitorID = identifier
+
+	// Visits are inserted right after being resolved, so the earlier visits of sessions merged by assignSession have already been moved
+	_, err = assignSession(q, &pending.Visit)
+	return err
+}
+
+// scrollDepth clamps the scroll depth sent by the tracker to 0-100, browsers can report slightly more than the page height when bouncing at the bottom
+func scrollDepth(depth *int) *int {
+	if depth == nil {
+		return nil
+	}
+	clamped := min(max(*depth, 0), 100)
+	return &clamped
+}
+
+var visitColumns = []string{"website_id", "website_domain", "timestamp", "referrer", "referrer_source", "url", "hostname", "pathname", "device_type", "os", "os_version", "browser", "browser_version", "screen_size", "language", "country", "region", "city", "country_code", "region_code", "continent", "country_geoname_id", "region_geoname_id", "city_geoname_id", "asn", "asn_organization", "is_datacenter", "is_unique", "time_spent_on_page", "utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "channel", "visitor_id", "session_id", "scroll_depth", "lcp", "cls", "inp", "fcp", "ttfb"}
+
+// visitRow returns the values of a visit in the same order as visitColumns
+func visitRow(visit models.VisitInsert) []interface{} {
+	return []interface{}{
+		visit.WebsiteID,
+		visit.WebsiteDomain,
+		visit.Timestamp,
+		visit.Referrer,
+		visit.ReferrerSource,
+		visit.URL,
+		visit.Hostname,
+		visit.Pathname,
+		visit.DeviceType,
+		visit.OS,
+		nullString(visit.OSVersion),
+		visit.Browser,
+		nullString(visit.BrowserVersion),
+		nullString(visit.ScreenSize),
+		visit.Language,
+		visit.Country,
+		visit.Region,
+		visit.City,
+		nullString(visit.CountryCode),
+		nullString(visit.RegionCode),
+		nullString(visit.Continent),
+		nullGeoNameID(visit.CountryID),
+		nullGeoNameID(visit.RegionID),
+		nullGeoNameID(visit.CityID),
+		nullASN(visit.ASN),
+		nullString(visit.ASNOrg),
+		visit.IsDatacenter,
+		visit.IsUnique,
+		visit.TimeSpentOnPage,
+		visit.UTMSource,
+		visit.UTMMedium,
+		visit.UTMCampaign,
+		visit.UTMTerm,
+		visit.UTMContent,
+		visit.Channel,
+		nullString(visit.VisitorID),
+		visit.SessionID,
+		visit.ScrollDepth,
+		visit.LCP,
+		visit.CLS,
+		visit.INP,
+		visit.FCP,
+		visit.TTFB,
+	}
+}
+
+// InsertVisit stores a resolved visit
+func InsertVisit(q Querier, visit models.VisitInsert) error {
+	return InsertVisits(q, []models.VisitInsert{visit})
+}
+
+// InsertVisits stores resolved visits using multi-row INSERT statements
+func InsertVisits(q Querier, visits []models.VisitInsert) error {
+	rows := make([][]interface{}, len(visits))
+	for i, visit := range visits {
+		rows[i] = visitRow(visit)
+	}
+	return bulkInsert(q, "visits", visitColumns, rows)
+}
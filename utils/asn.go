@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+//go:embed data/hosting_asns.txt
+var bundledHostingASNs []byte
+
+var hostingASNs = parseHostingASNs(bundledHostingASNs)
+
+// parseHostingASNs reads one autonomous system number per line, optionally followed by a tab and the provider name, skipping blank lines and # comments
+func parseHostingASNs(list []byte) map[uint]bool {
+	numbers := make(map[uint]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		field, _, _ := strings.Cut(line, "\t")
+		number, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			continue
+		}
+		numbers[uint(number)] = true
+	}
+	return numbers
+}
+
+// IsHostingASN reports whether the autonomous system belongs to a cloud, hosting or datacenter provider of the bundled list
+func IsHostingASN(number uint) bool {
+	return hostingASNs[number]
+}
+
+// ASN returns the autonomous system number and organization announcing the IP address, 0 and an empty string if it isn't in the database
+func (g *GeoIPDatabase) ASN(ip net.IP) (uint, string, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.reader == nil {
+		return 0, "", errors.New("geoip database closed")
+	}
+	var record geoip2.ASN
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return 0, "", err
+	}
+	return record.AutonomousSystemNumber, record.AutonomousSystemOrganization, nil
+}
+
+// ASNGeolocator adds the network of the visitor, looked up in an ASN database, to the location found by another Geolocator
+type ASNGeolocator struct {
+	Geolocator
+	ASNDatabase *GeoIPDatabase
+}
+
+// Locate implements Geolocator. A failed ASN lookup is logged and leaves the network unknown.
+func (a ASNGeolocator) Locate(ip net.IP, header http.Header) Location {
+	location := a.Geolocator.Locate(ip, header)
+
+	number, organization, err := a.ASNDatabase.ASN(ip)
+	if err != nil {
+		log.Printf("Error retrieving ASN for IP %v: %v", ip, err)
+		return location
+	}
+	location.ASN = number
+	location.ASNOrganization = organization
+	location.Datacenter = IsHostingASN(number)
+
+	return location
+}
+
+// WithASN returns a Geolocator adding the network of the visitor from asnDB to the locations found by geolocator, or geolocator itself if there is no ASN database
+func WithASN(geolocator Geolocator, asnDB *GeoIPDatabase) Geolocator {
+	if asnDB == nil {
+		return geolocator
+	}
+	return ASNGeolocator{Geolocator: geolocator, ASNDatabase: asnDB}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/mileusna/useragent"
+)
+
+// crawlerPatterns are lowercase user agent fragments of crawlers, uptime monitors, link previewers and http libraries that the useragent package doesn't flag as bots. Add new entries at the bottom of the relevant group.
+var crawlerPatterns = []string{
+	// generic markers
+	"bot/", "bot;", "bot)", "bot+", "-bot", "_bot", "crawler", "crawling", "spider", "scraper", "archiver", "fetcher",
+	// search engines and SEO tools
+	"googlebot", "adsbot-google", "mediapartners-google", "google-inspectiontool", "bingpreview", "slurp", "duckduckbot", "baiduspider", "sogou", "exabot", "seznambot", "petalbot", "ahrefs", "semrush", "mj12bot", "dotbot", "rogerbot", "screaming frog", "bytespider", "gptbot", "ccbot", "claudebot", "perplexitybot",
+	// link previews
+	"facebookexternalhit", "facebookcatalog", "twitterbot", "linkedinbot", "slackbot", "discordbot", "telegrambot", "skypeuripreview", "embedly",
+	// monitoring and performance tools
+	"pingdom", "uptimerobot", "statuscake", "site24x7", "newrelicpinger", "datadog", "gtmetrix", "lighthouse", "pagespeed", "chrome-lighthouse",
+	// http clients and libraries
+	"curl/", "wget/", "python-requests", "python-urllib", "aiohttp", "httpx", "go-http-client", "java/", "okhttp", "apache-httpclient", "axios/", "node-fetch", "undici", "libwww-perl", "scrapy", "postmanruntime", "insomnia", "httpie",
+}
+
+// headlessMarkers are lowercase user agent fragments left by headless browsers and automation frameworks
+var headlessMarkers = []string{
+	"headlesschrome", "headless", "phantomjs", "slimerjs", "puppeteer", "playwright", "selenium", "webdriver", "cypress", "htmlunit",
+}
+
+// IsBot reports whether the user agent belongs to a bot, a crawler, or a headless browser
+func IsBot(ua *useragent.UserAgent) bool {
+	if ua.Bot {
+		return true
+	}
+
+	userAgent := strings.ToLower(strings.TrimSpace(ua.String))
+
+	// Real browsers always send a user agent
+	if userAgent == "" {
+		return true
+	}
+
+	if strings.HasSuffix(userAgent, "bot") {
+		return true
+	}
+
+	for _, pattern := range crawlerPatterns {
+		if strings.Contains(userAgent, pattern) {
+			return true
+		}
+	}
+
+	for _, marker := range headlessMarkers {
+		if strings.Contains(userAgent, marker) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+)
+
+// Traffic channels a visit can be assigned to
+const (
+	ChannelDirect        = "Direct"
+	ChannelOrganicSearch = "Organic Search"
+	ChannelPaidSearch    = "Paid Search"
+	ChannelSocial        = "Social"
+	ChannelEmail         = "Email"
+	ChannelReferral      = "Referral"
+	ChannelCampaign      = "Campaign"
+)
+
+// utm_source values naming a search engine or a social network, for tagged links without a referrer
+var searchEngineSources = []string{"google", "bing", "yahoo", "duckduckgo", "baidu", "yandex", "ecosia", "qwant", "brave", "naver"}
+var socialSources = []string{"facebook", "fb", "instagram", "ig", "twitter", "linkedin", "reddit", "hackernews", "pinterest", "tiktok", "youtube", "threads", "bluesky", "mastodon", "whatsapp", "telegram"}
+
+var paidMediums = []string{"cpc", "ppc", "paid", "paidsearch", "paid-search", "paid_search", "sem"}
+var socialMediums = []string{"social", "social-network", "social-media", "social_network", "social_media", "sm"}
+var emailMediums = []string{"email", "e-mail", "e_mail", "newsletter"}
+
+// ClassifyChannel assigns a visit to a traffic channel from its referrer host and its UTM parameters. UTM tags win over the referrer because they are set on purpose by whoever shared the link. A referrer on the website itself (pageHost) is internal navigation and counts as Direct.
+func ClassifyChannel(referrerHost, pageHost, utmSource, utmMedium, utmCampaign string) string {
+	referrerHost = strings.TrimPrefix(strings.ToLower(referrerHost), "www.")
+	pageHost = strings.TrimPrefix(strings.ToLower(pageHost), "www.")
+	source := strings.ToLower(strings.TrimSpace(utmSource))
+	medium := strings.ToLower(strings.TrimSpace(utmMedium))
+
+	_, category := ReferrerSource(referrerHost)
+	isSearch := category == SourceCategorySearch || slices.Contains(searchEngineSources, source)
+	isSocial := category == SourceCategorySocial || slices.Contains(socialSources, source)
+
+	switch {
+	case slices.Contains(paidMediums, medium) && isSocial:
+		return ChannelSocial
+	case slices.Contains(paidMediums, medium):
+		return ChannelPaidSearch
+	case slices.Contains(emailMediums, medium) || strings.Contains(source, "email") || strings.Contains(source, "newsletter"):
+		return ChannelEmail
+	case slices.Contains(socialMediums, medium):
+		return ChannelSocial
+	case medium == "organic":
+		return ChannelOrganicSearch
+	}
+
+	if source != "" || medium != "" || strings.TrimSpace(utmCampaign) != "" {
+		switch {
+		case isSocial:
+			return ChannelSocial
+		case isSearch:
+			return ChannelOrganicSearch
+		default:
+			return ChannelCampaign
+		}
+	}
+
+	switch {
+	case referrerHost == "" || referrerHost == pageHost:
+		return ChannelDirect
+	case category == SourceCategoryEmail || strings.HasPrefix(referrerHost, "mail.") || strings.HasPrefix(referrerHost, "webmail."):
+		return ChannelEmail
+	case isSearch:
+		return ChannelOrganicSearch
+	case isSocial:
+		return ChannelSocial
+	default:
+		return ChannelReferral
+	}
+}
+
+// matchesHost reports whether host is the pattern domain or one of its subdomains. A pattern like "google.*" matches google followed by a country tld of at most two short labels (google.it, google.co.uk).
+func matchesHost(host, pattern string) bool {
+	name, anyTLD := strings.CutSuffix(pattern, ".*")
+	if !anyTLD {
+		return host == pattern || strings.HasSuffix(host, "."+pattern)
+	}
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if label != name {
+			continue
+		}
+		tld := labels[i+1:]
+		if len(tld) == 0 || len(tld) > 2 {
+			return false
+		}
+		for _, part := range tld {
+			if len(part) > 3 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
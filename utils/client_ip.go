@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Private, loopback, link-local and shared address space (CGNAT) ranges, IPv4 and IPv6
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"100.64.0.0/10",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   []*net.IPNet // nil trusts the private networks, proxies are usually on the same host or network
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// parseCIDRs parses CIDR ranges, a single address is taken as a /32 (or /128) range
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// LoadTrustedProxies replaces the proxies whose forwarding headers are trusted with a comma separated list of CIDR ranges or addresses (e.g. the TRUSTED_PROXIES environment variable). An empty list goes back to trusting the private networks. It returns the number of ranges loaded.
+func LoadTrustedProxies(list string) (int, error) {
+	networks, err := parseCIDRs(strings.Split(list, ","))
+	if err != nil {
+		return 0, err
+	}
+
+	trustedProxiesMu.Lock()
+	trustedProxies = networks
+	trustedProxiesMu.Unlock()
+
+	return len(networks), nil
+}
+
+// isTrustedProxy reports whether the forwarding headers set by the given peer can be trusted
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesMu.RLock()
+	networks := trustedProxies
+	trustedProxiesMu.RUnlock()
+
+	if networks == nil {
+		return isPrivateIP(ip)
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateIP checks if an IP address is private, loopback, link-local or in the shared address space
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromTrustedProxy reports whether the request was forwarded by a trusted proxy, whose headers (e.g. the location set by a CDN) can be believed
+func FromTrustedProxy(r *http.Request) bool {
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+	remoteIP := net.ParseIP(remoteAddr)
+	return remoteIP != nil && isTrustedProxy(remoteIP)
+}
+
+// GetIPAddress returns the IP address of the client. The forwarding headers are only read when the request comes from a trusted proxy, so that clients can't spoof their address: the Forwarded header (or X-Forwarded-For) is walked from right to left skipping the trusted proxies, and X-Real-IP is used when neither is set. It returns an empty string when a hop that isn't a trusted proxy can't be parsed (e.g. unknown or obfuscated), the client is behind it and the address of a proxy would pass for it.
+func GetIPAddress(r *http.Request) string {
+	remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Try RemoteAddr directly if SplitHostPort fails
+		remoteAddr = r.RemoteAddr
+	}
+	remoteIP := net.ParseIP(remoteAddr)
+	if remoteIP == nil {
+		return remoteAddr
+	}
+	if !isTrustedProxy(remoteIP) {
+		return remoteIP.String()
+	}
+
+	chain := forwardedChain(r.Header)
+	if chain == nil {
+		if xRealIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); xRealIP != nil {
+			return xRealIP.String()
+		}
+		return remoteIP.String()
+	}
+
+	// Every hop appends the address of its peer, the first one from the right that isn't a trusted proxy is the client
+	clientIP := remoteIP
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(chain[i])
+		if ip == nil {
+			// Unknown or obfuscated hop, the client address is hidden behind it
+			return ""
+		}
+		clientIP = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return clientIP.String()
+}
+
+// forwardedChain returns the addresses of the Forwarded header (RFC 7239), or of X-Forwarded-For if it isn't set, from the first hop to the last. Repeated headers are joined in order.
+func forwardedChain(header http.Header) []string {
+	var chain []string
+
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			var forwardedFor string
+			for _, pair := range strings.Split(element, ";") {
+				key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					forwardedFor = value
+				}
+			}
+			chain = append(chain, forwardedFor)
+		}
+		return chain
+	}
+
+	if xff := header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, ip := range strings.Split(strings.Join(xff, ","), ",") {
+			chain = append(chain, ip)
+		}
+	}
+	return chain
+}
+
+// parseForwardedIP parses a hop of X-Forwarded-For or the for= value of Forwarded, which can be quoted and carry a port ("[2001:db8::1]:4711", 192.0.2.60:4711). It returns nil for unknown or obfuscated hops.
+func parseForwardedIP(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return nil
+		}
+		value = value[1:end]
+	} else if strings.Count(value, ":") == 1 {
+		value, _, _ = strings.Cut(value, ":")
+	}
+
+	return net.ParseIP(value)
+}
@@ -0,0 +1,441 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// resetTrustedProxies goes back to trusting the private networks once the test is over
+func resetTrustedProxies(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		if _, err := LoadTrustedProxies(""); err != nil {
+			t.Fatalf("resetting trusted proxies: %v", err)
+		}
+	})
+}
+
+func TestGetIPAddress(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string // empty trusts the private networks
+		remoteAddr     string
+		headers        map[string][]string
+		want           string
+	}{
+		{
+			name:       "no forwarding headers",
+			remoteAddr: "203.0.113.5:1234",
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "spoofed X-Forwarded-For from an untrusted peer",
+			remoteAddr: "203.0.113.5:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "spoofed X-Real-IP from an untrusted peer",
+			remoteAddr: "203.0.113.5:1234",
+			headers:    map[string][]string{"X-Real-IP": {"198.51.100.7"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "spoofed Forwarded from an untrusted peer",
+			remoteAddr: "[2001:db8::5]:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.7"}},
+			want:       "2001:db8::5",
+		},
+		{
+			name:       "X-Real-IP from a trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-IP": {" 198.51.100.7 "}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "invalid X-Real-IP from a trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Real-IP": {"not-an-ip"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "X-Forwarded-For walked right to left across trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7, 192.168.1.20, 172.16.5.4, 10.0.0.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "spoofed leftmost X-Forwarded-For hop is ignored",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.0.0.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "X-Forwarded-For takes precedence over X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-IP": {"198.51.100.8"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "every hop trusted returns the leftmost one",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.168.1.20, 10.0.0.2"}},
+			want:       "192.168.1.20",
+		},
+		{
+			name:       "repeated X-Forwarded-For lines are joined in order",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7", "10.0.0.3"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "invalid X-Forwarded-For hop hides the client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"X-Forwarded-For": {"198.51.100.7, garbage, 10.0.0.2"}},
+			want:       "",
+		},
+		{
+			name:       "Forwarded takes precedence over X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.7;proto=https"}, "X-Forwarded-For": {"198.51.100.8"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "Forwarded walked right to left across trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.7, for=10.0.0.3;by=10.0.0.1, for=10.0.0.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "unknown Forwarded hop hides the client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.7, for=unknown, for=10.0.0.2"}},
+			want:       "",
+		},
+		{
+			name:       "obfuscated Forwarded hop hides the client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.7, for=_hidden"}},
+			want:       "",
+		},
+		{
+			name:       "Forwarded element without for hides the client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=198.51.100.7, proto=https"}},
+			want:       "",
+		},
+		{
+			name:       "quoted IPv6 Forwarded hop with a port",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for="[2001:db8:cafe::17]:4711"`}},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "IPv4 Forwarded hop with a port",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {`for="192.0.2.60:4711"`}},
+			want:       "192.0.2.60",
+		},
+		{
+			name:       "repeated Forwarded lines are joined in order",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string][]string{"Forwarded": {"for=1.2.3.4, for=198.51.100.7", "for=10.0.0.3"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "IPv6 trusted peer",
+			remoteAddr: "[::1]:8080",
+			headers:    map[string][]string{"X-Forwarded-For": {"2001:db8::5, fd00::2"}},
+			want:       "2001:db8::5",
+		},
+		{
+			name:       "remote address without a port",
+			remoteAddr: "203.0.113.5",
+			want:       "203.0.113.5",
+		},
+		{
+			name:           "configured proxies replace the private networks",
+			trustedProxies: "192.0.2.10",
+			remoteAddr:     "10.0.0.1:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"198.51.100.7"}},
+			want:           "10.0.0.1",
+		},
+		{
+			name:           "configured proxy is trusted",
+			trustedProxies: "192.0.2.10, 2001:db8:1::/48",
+			remoteAddr:     "192.0.2.10:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"198.51.100.7, 2001:db8:1::9"}},
+			want:           "198.51.100.7",
+		},
+		{
+			name:           "private hops aren't trusted unless configured",
+			trustedProxies: "192.0.2.10",
+			remoteAddr:     "192.0.2.10:1234",
+			headers:        map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2"}},
+			want:           "10.0.0.2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTrustedProxies(t)
+			if _, err := LoadTrustedProxies(tt.trustedProxies); err != nil {
+				t.Fatalf("LoadTrustedProxies(%q): %v", tt.trustedProxies, err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/visit", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.headers {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+
+			if got := GetIPAddress(r); got != tt.want {
+				t.Errorf("GetIPAddress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedChain(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    []string
+	}{
+		{
+			name: "no headers",
+			want: nil,
+		},
+		{
+			name:    "X-Forwarded-For",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2"}},
+			want:    []string{"198.51.100.7", " 10.0.0.2"},
+		},
+		{
+			name:    "repeated X-Forwarded-For lines",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7", "10.0.0.2, 10.0.0.3"}},
+			want:    []string{"198.51.100.7", "10.0.0.2", " 10.0.0.3"},
+		},
+		{
+			name:    "Forwarded with other parameters",
+			headers: map[string][]string{"Forwarded": {"for=192.0.2.60;proto=http;by=203.0.113.43, For=\"[2001:db8::1]:80\""}},
+			want:    []string{"192.0.2.60", "\"[2001:db8::1]:80\""},
+		},
+		{
+			name:    "Forwarded element without for",
+			headers: map[string][]string{"Forwarded": {"proto=https;by=10.0.0.1"}},
+			want:    []string{""},
+		},
+		{
+			name:    "repeated Forwarded lines",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7", "for=unknown"}},
+			want:    []string{"198.51.100.7", "unknown"},
+		},
+		{
+			name:    "Forwarded wins over X-Forwarded-For",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7"}, "X-Forwarded-For": {"198.51.100.8"}},
+			want:    []string{"198.51.100.7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, values := range tt.headers {
+				for _, value := range values {
+					header.Add(name, value)
+				}
+			}
+
+			got := forwardedChain(header)
+			if len(got) != len(tt.want) {
+				t.Fatalf("forwardedChain() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("forwardedChain() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseForwardedIP(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // empty if the hop can't be parsed
+	}{
+		{value: "192.0.2.60", want: "192.0.2.60"},
+		{value: " 192.0.2.60 ", want: "192.0.2.60"},
+		{value: "192.0.2.60:4711", want: "192.0.2.60"},
+		{value: `"192.0.2.60:4711"`, want: "192.0.2.60"},
+		{value: "2001:db8::1", want: "2001:db8::1"},
+		{value: "[2001:db8::1]", want: "2001:db8::1"},
+		{value: "[2001:db8:cafe::17]:4711", want: "2001:db8:cafe::17"},
+		{value: `"[2001:db8:cafe::17]:4711"`, want: "2001:db8:cafe::17"},
+		{value: "[2001:db8::1", want: ""},
+		{value: "unknown", want: ""},
+		{value: "_hidden", want: ""},
+		{value: `"_SEVKISEK"`, want: ""},
+		{value: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := parseForwardedIP(tt.value)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("parseForwardedIP(%q) = %v, want nil", tt.value, got)
+				}
+				return
+			}
+			if !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("parseForwardedIP(%q) = %v, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name      string
+		list      string
+		wantCount int
+		wantErr   bool
+		trusted   []string
+		untrusted []string
+	}{
+		{
+			name:      "single addresses",
+			list:      "192.0.2.10, 2001:db8::1",
+			wantCount: 2,
+			trusted:   []string{"192.0.2.10", "2001:db8::1"},
+			untrusted: []string{"192.0.2.11", "2001:db8::2", "10.0.0.1"},
+		},
+		{
+			name:      "ranges and blank entries",
+			list:      " 198.51.100.0/24 ,, 2001:db8:1::/48 ",
+			wantCount: 2,
+			trusted:   []string{"198.51.100.200", "2001:db8:1:ffff::1"},
+			untrusted: []string{"198.51.101.1", "2001:db8:2::1"},
+		},
+		{
+			name:      "empty list trusts the private networks",
+			list:      "",
+			wantCount: 0,
+			trusted:   []string{"10.0.0.1", "::1"},
+			untrusted: []string{"192.0.2.10"},
+		},
+		{name: "invalid address", list: "192.0.2.10, not-an-ip", wantErr: true},
+		{name: "invalid prefix length", list: "10.0.0.0/33", wantErr: true},
+		{name: "invalid range", list: "10.0.0/8", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTrustedProxies(t)
+
+			count, err := LoadTrustedProxies(tt.list)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadTrustedProxies(%q) succeeded, want an error", tt.list)
+				}
+				// The previous configuration (the private networks) stays in place
+				if !isTrustedProxy(net.ParseIP("10.0.0.1")) {
+					t.Errorf("private networks no longer trusted after a failed load")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadTrustedProxies(%q): %v", tt.list, err)
+			}
+			if count != tt.wantCount {
+				t.Errorf("LoadTrustedProxies(%q) = %d ranges, want %d", tt.list, count, tt.wantCount)
+			}
+			for _, ip := range tt.trusted {
+				if !isTrustedProxy(net.ParseIP(ip)) {
+					t.Errorf("%s not trusted", ip)
+				}
+			}
+			for _, ip := range tt.untrusted {
+				if isTrustedProxy(net.ParseIP(ip)) {
+					t.Errorf("%s trusted", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		// 10.0.0.0/8
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		// 172.16.0.0/12
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.15.255.255", false},
+		{"172.32.0.1", false},
+		// 192.168.0.0/16
+		{"192.168.1.1", true},
+		{"192.169.0.1", false},
+		// 127.0.0.0/8
+		{"127.0.0.1", true},
+		{"127.255.255.254", true},
+		// 169.254.0.0/16
+		{"169.254.169.254", true},
+		// 100.64.0.0/10
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"100.63.255.255", false},
+		{"100.128.0.1", false},
+		// ::1/128
+		{"::1", true},
+		{"::2", false},
+		// fc00::/7
+		{"fc00::1", true},
+		{"fd12:3456:789a::1", true},
+		{"fe00::1", false},
+		// fe80::/10
+		{"fe80::1", true},
+		{"febf:ffff::1", true},
+		{"fec0::1", false},
+		// IPv4-mapped IPv6 addresses are matched as IPv4
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		// public addresses
+		{"8.8.8.8", false},
+		{"203.0.113.5", false},
+		{"2001:db8::1", false},
+		{"2606:4700::1111", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	// Every range has to be covered by at least one private address above
+	for _, network := range privateNetworks {
+		covered := false
+		for _, tt := range tests {
+			if tt.want && network.Contains(net.ParseIP(tt.ip)) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			t.Errorf("no test case for private range %s", network)
+		}
+	}
+}
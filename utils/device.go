@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mileusna/useragent"
+)
+
+// Device is what the dashboard knows about the browser and the device of a visitor
+type Device struct {
+	Type           string // Mobile, Tablet, Desktop, Bot or Unknown
+	OS             string
+	OSVersion      string // e.g. 11 for Windows, 14.4 for macOS, 17 for Android, empty if unknown
+	Browser        string
+	BrowserVersion string // major version, major.minor for Safari, empty if unknown
+}
+
+// ClientHints holds the User-Agent Client Hints (Sec-CH-UA-*) sent by Chromium browsers, which keep reporting the real platform version while their user agent string is frozen (e.g. Windows NT 10.0 on Windows 11, Android 10; K on any Android).
+type ClientHints struct {
+	Brands          map[string]string // brand -> full version (Sec-CH-UA-Full-Version-List), or major version (Sec-CH-UA) if the full list isn't sent
+	Mobile          *bool             // Sec-CH-UA-Mobile, nil if not sent
+	Platform        string            // Sec-CH-UA-Platform, e.g. Windows, macOS, Android
+	PlatformVersion string            // Sec-CH-UA-Platform-Version, e.g. 15.0.0
+}
+
+// ParseClientHints reads the client hints of a browser request. Sec-CH-UA, Sec-CH-UA-Mobile and Sec-CH-UA-Platform are sent on every secure request, the platform version and the full version list only if the website delegates them to the tracker domain (see README).
+func ParseClientHints(header http.Header) ClientHints {
+	var hints ClientHints
+
+	brands := header.Get("Sec-CH-UA-Full-Version-List")
+	if brands == "" {
+		brands = header.Get("Sec-CH-UA")
+	}
+	hints.Brands = parseBrandList(brands)
+
+	switch strings.TrimSpace(header.Get("Sec-CH-UA-Mobile")) {
+	case "?1":
+		mobile := true
+		hints.Mobile = &mobile
+	case "?0":
+		mobile := false
+		hints.Mobile = &mobile
+	}
+
+	hints.Platform = unquoteHint(header.Get("Sec-CH-UA-Platform"))
+	hints.PlatformVersion = unquoteHint(header.Get("Sec-CH-UA-Platform-Version"))
+
+	return hints
+}
+
+// parseBrandList parses a structured header brand list like "Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"
+func parseBrandList(list string) map[string]string {
+	brands := make(map[string]string)
+	for _, item := range strings.Split(list, ",") {
+		brand, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		brand = unquoteHint(brand)
+		if brand == "" {
+			continue
+		}
+		var version string
+		for _, param := range strings.Split(params, ";") {
+			if value, found := strings.CutPrefix(strings.TrimSpace(param), "v="); found {
+				version = unquoteHint(value)
+			}
+		}
+		brands[brand] = version
+	}
+	return brands
+}
+
+func unquoteHint(value string) string {
+	return strings.Trim(strings.TrimSpace(value), `"`)
+}
+
+// Brands of Sec-CH-UA under the names the useragent package gives the browsers
+var clientHintBrowsers = map[string]string{
+	"Google Chrome":    useragent.Chrome,
+	"Microsoft Edge":   useragent.Edge,
+	"Opera":            useragent.Opera,
+	"Vivaldi":          useragent.Vivaldi,
+	"Samsung Internet": useragent.SamsungBrowser,
+}
+
+// Platforms of Sec-CH-UA-Platform under the names the useragent package gives the operating systems
+var clientHintPlatforms = map[string]string{
+	"Windows":   useragent.Windows,
+	"macOS":     useragent.MacOS,
+	"Android":   useragent.Android,
+	"iOS":       useragent.IOS,
+	"Linux":     useragent.Linux,
+	"Chrome OS": useragent.ChromeOS,
+}
+
+// DetectDevice works out the device of a visitor from the parsed user agent, preferring the client hints when they are present
+func DetectDevice(ua *useragent.UserAgent, hints ClientHints) Device {
+	device := Device{
+		Type:           GetDeviceType(ua),
+		OS:             ua.OS,
+		OSVersion:      osVersion(ua.OS, ua.OSVersionNo.Major, ua.OSVersionNo.Minor),
+		Browser:        ua.Name,
+		BrowserVersion: browserVersion(ua.Name, ua.VersionNo.Major, ua.VersionNo.Minor),
+	}
+
+	if os, ok := clientHintPlatforms[hints.Platform]; ok {
+		device.OS = os
+		if major, minor, ok := parseVersion(hints.PlatformVersion); ok {
+			device.OSVersion = platformVersion(os, major, minor)
+		} else if os != ua.OS || device.OSVersion == frozenOSVersions[os] {
+			// Without the platform version the version of a frozen user agent string is as good as unknown
+			device.OSVersion = ""
+		}
+	}
+
+	for brand, version := range hints.Brands {
+		browser, ok := clientHintBrowsers[brand]
+		if !ok || browser != device.Browser {
+			continue
+		}
+		if major, minor, ok := parseVersion(version); ok {
+			device.BrowserVersion = browserVersion(browser, major, minor)
+		}
+	}
+
+	// Sec-CH-UA-Mobile doesn't tell tablets apart from desktops, so it only corrects phones reported as something else
+	if hints.Mobile != nil && *hints.Mobile && device.Type != "Bot" {
+		device.Type = "Mobile"
+	}
+
+	return device
+}
+
+// parseVersion parses the major and minor numbers of a dotted version
+func parseVersion(version string) (int, int, bool) {
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor, true
+}
+
+// browserVersion formats the version of a browser, which is only meaningful down to the major version except for Safari
+func browserVersion(browser string, major, minor int) string {
+	if major == 0 && minor == 0 {
+		return ""
+	}
+	if browser == useragent.Safari || browser == useragent.MobileSafari {
+		return fmt.Sprintf("%d.%d", major, minor)
+	}
+	return strconv.Itoa(major)
+}
+
+// Windows NT versions of the user agent string and the Windows release they stand for. Windows 11 still sends NT 10.0, only the client hints tell it apart.
+var windowsNTVersions = map[string]string{
+	"10.0": "10",
+	"6.3":  "8.1",
+	"6.2":  "8",
+	"6.1":  "7",
+	"6.0":  "Vista",
+	"5.1":  "XP",
+}
+
+// Versions the frozen user agent string of Chromium browsers reports whatever the actual version is
+var frozenOSVersions = map[string]string{
+	useragent.Windows: "10",
+	useragent.MacOS:   "10.15",
+	useragent.Android: "10",
+}
+
+// osVersion formats the version of an operating system parsed from the user agent string
+func osVersion(os string, major, minor int) string {
+	if major == 0 && minor == 0 {
+		return ""
+	}
+	switch os {
+	case useragent.Windows:
+		return windowsNTVersions[fmt.Sprintf("%d.%d", major, minor)]
+	case useragent.Android:
+		return strconv.Itoa(major)
+	default:
+		return fmt.Sprintf("%d.%d", major, minor)
+	}
+}
+
+// platformVersion formats the Sec-CH-UA-Platform-Version of an operating system. On Windows it is the version of the Universal API contract: 13 and above is Windows 11, 1 to 12 Windows 10 and 0 older versions.
+func platformVersion(os string, major, minor int) string {
+	switch os {
+	case useragent.Windows:
+		switch {
+		case major >= 13:
+			return "11"
+		case major >= 1:
+			return "10"
+		default:
+			return ""
+		}
+	case useragent.Android:
+		return strconv.Itoa(major)
+	default:
+		return fmt.Sprintf("%d.%d", major, minor)
+	}
+}
+
+// ScreenSize returns the bucket of a screen width in CSS pixels, empty if the tracker didn't send it
+func ScreenSize(width int) string {
+	switch {
+	case width <= 0:
+		return ""
+	case width < 576:
+		return "<576px"
+	case width < 768:
+		return "576-767px"
+	case width < 992:
+		return "768-991px"
+	case width < 1200:
+		return "992-1199px"
+	case width < 1440:
+		return "1200-1439px"
+	case width < 1920:
+		return "1440-1919px"
+	default:
+		return "1920px+"
+	}
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// How often the GeoIP database file is checked for changes unless GEOIP_RELOAD_INTERVAL is set
+const DefaultGeoIPReloadInterval = time.Minute
+
+// GeoIPDatabase is an MMDB database file, the Geolocator for city databases and the source of ASN lookups for ASN databases (see OpenASNDatabase). It swaps in a new database when the file changes, without restarting the server.
+type GeoIPDatabase struct {
+	path         string
+	databaseType string     // the database type has to contain it (City, ASN), any type is accepted if empty
+	reloadMu     sync.Mutex // one reload at a time
+
+	mu      sync.RWMutex // lookups hold the read lock, so a reader is never closed while it is in use
+	reader  *maxminddb.Reader
+	modTime time.Time // of the file the last reload attempt read
+	size    int64
+}
+
+// OpenGeoIPDatabase opens and validates the city database at path. With maxMind set the file has to be a MaxMind City database (GeoLite2-City, GeoIP2-City), otherwise any MMDB file using the same record layout is accepted, like the DB-IP and IP2Location lite city databases.
+func OpenGeoIPDatabase(path string, maxMind bool) (*GeoIPDatabase, error) {
+	databaseType := ""
+	if maxMind {
+		databaseType = "City"
+	}
+	return openGeoIPDatabase(path, databaseType)
+}
+
+// OpenASNDatabase opens and validates the GeoLite2-ASN (or GeoIP2-ISP) database at path, used to find the network the visitors come from
+func OpenASNDatabase(path string) (*GeoIPDatabase, error) {
+	return openGeoIPDatabase(path, "ASN")
+}
+
+func openGeoIPDatabase(path, databaseType string) (*GeoIPDatabase, error) {
+	reader, info, err := openGeoIPReader(path, databaseType)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIPDatabase{
+		path:         path,
+		databaseType: databaseType,
+		reader:       reader,
+		modTime:      info.ModTime(),
+		size:         info.Size(),
+	}, nil
+}
+
+// openGeoIPReader opens the database and makes sure it is a working database of the expected type before it is used
+func openGeoIPReader(path, databaseType string) (*maxminddb.Reader, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, info, err
+	}
+
+	if !strings.Contains(reader.Metadata.DatabaseType, databaseType) {
+		reader.Close()
+		return nil, info, fmt.Errorf("%s is a %s database, not a %s database", path, reader.Metadata.DatabaseType, databaseType)
+	}
+	var record interface{} = &geoip2.City{}
+	if databaseType == "ASN" {
+		record = &geoip2.ASN{}
+	}
+	if err := reader.Lookup(net.ParseIP("8.8.8.8"), record); err != nil {
+		reader.Close()
+		return nil, info, fmt.Errorf("test lookup failed: %w", err)
+	}
+
+	return reader, info, nil
+}
+
+// City looks up the city record of the IP address in the current database
+func (g *GeoIPDatabase) City(ip net.IP) (*geoip2.City, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.reader == nil {
+		return nil, errors.New("geoip database closed")
+	}
+	var record geoip2.City
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Locate implements Geolocator. A failed lookup is logged and degrades to an unknown location, so the hit is still stored.
+func (g *GeoIPDatabase) Locate(ip net.IP, _ http.Header) Location {
+	record, err := g.City(ip)
+	if err != nil {
+		log.Printf("Error retrieving location for IP %v: %v", ip, err)
+		return unknownLocation()
+	}
+	return GetLocationInfo(record)
+}
+
+// BuildTime returns when the current database was built by its provider
+func (g *GeoIPDatabase) BuildTime() time.Time {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.reader == nil {
+		return time.Time{}
+	}
+	return time.Unix(int64(g.reader.Metadata.BuildEpoch), 0).UTC()
+}
+
+// Path returns the path of the database file
+func (g *GeoIPDatabase) Path() string {
+	return g.path
+}
+
+// Reload opens the database file again and swaps it in. If the new file can't be opened or isn't a valid database of the same type, the current one keeps being used and the error is returned.
+func (g *GeoIPDatabase) Reload() error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	reader, info, err := openGeoIPReader(g.path, g.databaseType)
+
+	g.mu.Lock()
+	if info != nil {
+		// Remembered even when the file is invalid, so that the watcher only retries once the file changes again
+		g.modTime, g.size = info.ModTime(), info.Size()
+	}
+	if err != nil {
+		g.mu.Unlock()
+		return err
+	}
+	previous := g.reader
+	g.reader = reader
+	g.mu.Unlock()
+
+	// Lookups on the previous reader are over once the write lock has been taken
+	if previous != nil {
+		previous.Close()
+	}
+
+	log.Printf("Reloaded GeoIP database %s (built %s)", g.path, g.BuildTime().Format(time.DateOnly))
+	return nil
+}
+
+// changed reports whether the database file has been modified since it was last read
+func (g *GeoIPDatabase) changed() bool {
+	info, err := os.Stat(g.path)
+	if err != nil {
+		return false // the file is probably being replaced, it will be picked up on the next check
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !info.ModTime().Equal(g.modTime) || info.Size() != g.size
+}
+
+// Watch checks the database file every interval and reloads it when it changes (e.g. after geoipupdate ran). It blocks, so it's meant to run in its own goroutine, and returns right away if interval isn't positive.
+func (g *GeoIPDatabase) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !g.changed() {
+			continue
+		}
+		if err := g.Reload(); err != nil {
+			log.Printf("Error reloading GeoIP database, keeping the current one: %v", err)
+		}
+	}
+}
+
+// Close closes the current database, lookups fail afterwards
+func (g *GeoIPDatabase) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.reader == nil {
+		return nil
+	}
+	err := g.reader.Close()
+	g.reader = nil
+	return err
+}
+
+// GeoIPReloadIntervalFromEnv reads the GEOIP_RELOAD_INTERVAL environment variable (e.g. 5m, 0 disables watching the file), falling back to DefaultGeoIPReloadInterval
+func GeoIPReloadIntervalFromEnv() time.Duration {
+	value := os.Getenv("GEOIP_RELOAD_INTERVAL")
+	if value == "" {
+		return DefaultGeoIPReloadInterval
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		log.Printf("Ignoring GEOIP_RELOAD_INTERVAL %q, using %s", value, DefaultGeoIPReloadInterval)
+		return DefaultGeoIPReloadInterval
+	}
+	return interval
+}
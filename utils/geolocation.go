@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Geolocator returns the location of a visitor. header holds the headers of the ingest request when they can be trusted to describe the visitor, nil otherwise (e.g. server-side hits, whose request comes from the backend of the website). Implementations never fail, an unknown location is returned instead.
+type Geolocator interface {
+	Locate(ip net.IP, header http.Header) Location
+}
+
+// Geolocation providers, selected with the GEOLOCATION_PROVIDER environment variable
+const (
+	GeolocationMaxMind = "maxmind" // MaxMind GeoLite2/GeoIP2 City database at GEOIP_DB_PATH
+	GeolocationMMDB    = "mmdb"    // any city MMDB file with the MaxMind layout at GEOIP_DB_PATH, e.g. the DB-IP or IP2Location lite databases
+	GeolocationHeader  = "header"  // country (and region/city if available) sent by a CDN in front of the server, e.g. CF-IPCountry
+	GeolocationNone    = "none"    // every visitor has an unknown location
+)
+
+//go:embed data/countries.txt
+var bundledCountries []byte
+
+var countryNames = parseCountries(bundledCountries)
+
+// parseCountries reads one tab separated ISO 3166-1 alpha-2 code and English name per line, skipping blank lines and # comments
+func parseCountries(list []byte) map[string]string {
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if code, name, found := strings.Cut(line, "\t"); found {
+			names[code] = strings.TrimSpace(name)
+		}
+	}
+	return names
+}
+
+// HeaderGeolocator reads the location set by a CDN or proxy in front of the server. Only the country header is required, the others are read when present (Cloudflare sends them with the "Add visitor location headers" managed transform).
+type HeaderGeolocator struct {
+	CountryHeader    string // ISO 3166-1 alpha-2 code
+	ContinentHeader  string
+	RegionHeader     string
+	RegionCodeHeader string // subdivision part of the ISO 3166-2 code, e.g. 25 for IT-25
+	CityHeader       string
+}
+
+// NewHeaderGeolocator reads the Cloudflare location headers, with countryHeader replacing CF-IPCountry if it isn't empty
+func NewHeaderGeolocator(countryHeader string) HeaderGeolocator {
+	if countryHeader == "" {
+		countryHeader = "CF-IPCountry"
+	}
+	return HeaderGeolocator{
+		CountryHeader:    countryHeader,
+		ContinentHeader:  "CF-IPContinent",
+		RegionHeader:     "CF-Region",
+		RegionCodeHeader: "CF-Region-Code",
+		CityHeader:       "CF-IPCity",
+	}
+}
+
+// Locate implements Geolocator
+func (h HeaderGeolocator) Locate(_ net.IP, header http.Header) Location {
+	location := unknownLocation()
+	if header == nil {
+		return location
+	}
+
+	// XX is sent for unknown countries and T1 for Tor exit nodes
+	code := strings.ToUpper(strings.TrimSpace(header.Get(h.CountryHeader)))
+	name, ok := countryNames[code]
+	if !ok {
+		return location
+	}
+	location.Country = name
+	location.CountryCode = code
+	location.Continent = strings.ToUpper(strings.TrimSpace(header.Get(h.ContinentHeader)))
+
+	if region := strings.TrimSpace(header.Get(h.RegionHeader)); region != "" {
+		location.Region = region
+	}
+	if regionCode := strings.ToUpper(strings.TrimSpace(header.Get(h.RegionCodeHeader))); regionCode != "" {
+		location.RegionCode = code + "-" + regionCode
+	}
+	if city := strings.TrimSpace(header.Get(h.CityHeader)); city != "" {
+		location.City = city
+	}
+
+	return location
+}
+
+// NoopGeolocator doesn't locate anyone, for servers running without a geolocation database
+type NoopGeolocator struct{}
+
+// Locate implements Geolocator
+func (NoopGeolocator) Locate(net.IP, http.Header) Location {
+	return unknownLocation()
+}
+
+// NewGeolocator returns the geolocator of the given provider. path is the database file of the maxmind and mmdb providers, countryHeader the header read by the header provider (CF-IPCountry if empty).
+func NewGeolocator(provider, path, countryHeader string) (Geolocator, error) {
+	switch provider {
+	case GeolocationMaxMind, GeolocationMMDB, "":
+		geoipDB, err := OpenGeoIPDatabase(path, provider != GeolocationMMDB)
+		if err != nil {
+			return nil, err // not a nil *GeoIPDatabase wrapped in the interface
+		}
+		return geoipDB, nil
+	case GeolocationHeader:
+		return NewHeaderGeolocator(countryHeader), nil
+	case GeolocationNone:
+		return NoopGeolocator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown geolocation provider %q, expected one of maxmind, mmdb, header or none", provider)
+	}
+}
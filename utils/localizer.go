@@ -1,87 +1,71 @@
 package utils
 
 import (
-	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/oschwald/geoip2-golang"
 )
 
-// GetIPAddress tries different methods to get the real IP address
-func GetIPAddress(r *http.Request) string {
-	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		// Take the first non-private IP from X-Forwarded-For
-		for _, ip := range ips {
-			trimmedIP := strings.TrimSpace(ip)
-			parsedIP := net.ParseIP(trimmedIP)
-			if parsedIP != nil && !isPrivateIP(parsedIP) {
-				return trimmedIP
-			}
-		}
-	}
-
-	// Check X-Real-IP header
-	if xRealIP := r.Header.Get("X-Real-IP"); xRealIP != "" {
-		if parsedIP := net.ParseIP(xRealIP); parsedIP != nil {
-			return xRealIP
-		}
-	}
-
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// Try RemoteAddr directly if SplitHostPort fails
-		return r.RemoteAddr
-	}
-	return ip
-}
+// Location holds the parsed location information
+type Location struct {
+	Country     string
+	Region      string
+	City        string
+	CountryCode string // ISO 3166-1 alpha-2, e.g. IT, empty if unknown
+	RegionCode  string // ISO 3166-2, e.g. IT-25, empty if unknown
+	Continent   string // continent code, e.g. EU, empty if unknown
 
-// isPrivateIP checks if an IP address is private
-func isPrivateIP(ip net.IP) bool {
-	privateNetworks := []struct {
-		network *net.IPNet
-	}{
-		{&net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}},
-		{&net.IPNet{IP: net.ParseIP("172.16.0.0"), Mask: net.CIDRMask(12, 32)}},
-		{&net.IPNet{IP: net.ParseIP("192.168.0.0"), Mask: net.CIDRMask(16, 32)}},
-	}
+	// GeoNames IDs, 0 if unknown or not provided by the geolocator
+	CountryID uint
+	RegionID  uint
+	CityID    uint
 
-	for _, network := range privateNetworks {
-		if network.network.Contains(ip) {
-			return true
-		}
-	}
-	return false
-}
+	Names map[uint]map[string]string // localized names of the ids above, by locale (e.g. de, pt-BR)
 
-// Location holds the parsed location information
-type Location struct {
-	Country string
-	Region  string
-	City    string
+	// Network of the visitor, only known when an ASN database is configured (see WithASN)
+	ASN             uint
+	ASNOrganization string
+	Datacenter      bool // the ASN belongs to a cloud, hosting or datacenter provider
 }
 
-// GetLocationInfo extracts location information from the GeoIP record
-func GetLocationInfo(record *geoip2.City) Location {
-	location := Location{
+// unknownLocation is stored when the IP can't be located
+func unknownLocation() Location {
+	return Location{
 		Country: "Unknown",
 		Region:  "Unknown",
 		City:    "Unknown",
 	}
+}
+
+// GetLocationInfo extracts location information from the GeoIP record
+func GetLocationInfo(record *geoip2.City) Location {
+	location := unknownLocation()
+	location.Names = make(map[uint]map[string]string)
 
 	if record.Country.Names != nil {
 		if countryName, ok := record.Country.Names["en"]; ok {
 			location.Country = countryName
 		}
 	}
+	location.CountryCode = record.Country.IsoCode
+	location.Continent = record.Continent.Code
+	location.CountryID = record.Country.GeoNameID
+	addLocalizedNames(location.Names, record.Country.GeoNameID, record.Country.Names)
 
-	if len(record.Subdivisions) > 0 && record.Subdivisions[0].Names != nil {
-		if regionName, ok := record.Subdivisions[0].Names["en"]; ok {
-			location.Region = regionName
+	if len(record.Subdivisions) > 0 {
+		if record.Subdivisions[0].Names != nil {
+			if regionName, ok := record.Subdivisions[0].Names["en"]; ok {
+				location.Region = regionName
+			}
+		}
+		if location.CountryCode != "" && record.Subdivisions[0].IsoCode != "" {
+			location.RegionCode = location.CountryCode + "-" + record.Subdivisions[0].IsoCode
 		}
+		location.RegionID = record.Subdivisions[0].GeoNameID
+		addLocalizedNames(location.Names, record.Subdivisions[0].GeoNameID, record.Subdivisions[0].Names)
 	}
 
 	if record.City.Names != nil {
@@ -89,6 +73,78 @@ func GetLocationInfo(record *geoip2.City) Location {
 			location.City = cityName
 		}
 	}
+	location.CityID = record.City.GeoNameID
+	addLocalizedNames(location.Names, record.City.GeoNameID, record.City.Names)
 
 	return location
 }
+
+func addLocalizedNames(names map[uint]map[string]string, geoNameID uint, localized map[string]string) {
+	if geoNameID != 0 && len(localized) > 0 {
+		names[geoNameID] = localized
+	}
+}
+
+// Locales the geographic names are available in, DefaultLocale is the one stored along with the visits. These are the locales of the MaxMind databases, other languages (e.g. Italian) get the names in English.
+var SupportedLocales = []string{"de", "en", "es", "fr", "ja", "pt-BR", "ru", "zh-CN"}
+
+const DefaultLocale = "en"
+
+// RequestLocale returns the supported locale geographic names should be shown in: the locale query parameter if it is set, then the preferred languages of the Accept-Language header, falling back to English. fallback is set when the preferred language isn't supported, so that the dashboard can tell the names aren't in it.
+func RequestLocale(r *http.Request) (locale string, fallback bool) {
+	if tag := r.URL.Query().Get("locale"); tag != "" {
+		if locale := matchLocale(tag); locale != "" {
+			return locale, false
+		}
+		return DefaultLocale, true
+	}
+
+	type weightedTag struct {
+		tag     string
+		quality float64
+	}
+	var tags []weightedTag
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				quality = parsed
+			}
+		}
+		if tag != "" && tag != "*" && quality > 0 {
+			tags = append(tags, weightedTag{tag: tag, quality: quality})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].quality > tags[j].quality })
+
+	for i, tag := range tags {
+		if locale := matchLocale(tag.tag); locale != "" {
+			return locale, i > 0
+		}
+	}
+	return DefaultLocale, len(tags) > 0
+}
+
+// matchLocale maps a language tag to a supported locale, exactly (pt-BR) or by language (de-CH to de, pt to pt-BR). It returns an empty string if there is none.
+func matchLocale(tag string) string {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), "_", "-")
+	if tag == "" {
+		return ""
+	}
+
+	for _, locale := range SupportedLocales {
+		if strings.EqualFold(tag, locale) {
+			return locale
+		}
+	}
+
+	language, _, _ := strings.Cut(tag, "-")
+	for _, locale := range SupportedLocales {
+		localeLanguage, _, _ := strings.Cut(locale, "-")
+		if strings.EqualFold(language, localeLanguage) {
+			return locale
+		}
+	}
+	return ""
+}
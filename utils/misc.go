@@ -54,6 +54,17 @@ func ExtractDomainFromURL(r *http.Request) (string, error) {
 	return domain, nil
 }
 
+func ExtractHostnameFromURL(r *http.Request) (string, error) {
+	vars := mux.Vars(r)
+
+	hostname, ok := vars["hostname"]
+	if !ok {
+		return "", errors.New("hostname not provided in the URL")
+	}
+
+	return hostname, nil
+}
+
 func GetDeviceType(ua *useragent.UserAgent) string {
 	if ua.Mobile {
 		return "Mobile"
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	_ "embed"
+	"encoding/json"
+	"strings"
+)
+
+// Categories of the bundled referrer sources, used to classify traffic channels
+const (
+	SourceCategorySearch = "search"
+	SourceCategorySocial = "social"
+	SourceCategoryEmail  = "email"
+)
+
+// referrerSource maps referrer hosts to a friendly name. Hosts are matched together with their subdomains, and a trailing ".*" matches the name under any country tld (google.com, google.co.uk, google.it).
+type referrerSource struct {
+	Name     string   `json:"name"`
+	Category string   `json:"category"`
+	Hosts    []string `json:"hosts"`
+}
+
+//go:embed data/referrer_sources.json
+var bundledReferrerSources []byte
+
+var referrerSources = parseReferrerSources(bundledReferrerSources)
+
+func parseReferrerSources(data []byte) []referrerSource {
+	var sources []referrerSource
+	if err := json.Unmarshal(data, &sources); err != nil {
+		panic("invalid bundled referrer sources: " + err.Error())
+	}
+	return sources
+}
+
+// ReferrerSource returns the friendly name of a referrer host and the category of the source (search, social, email or empty). Unknown hosts are their own source, without the www. prefix. An empty host is a Direct visit.
+func ReferrerSource(host string) (string, string) {
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	if host == "" {
+		return "Direct", ""
+	}
+
+	// The most specific host wins, so mail.google.com is Gmail and not Google
+	var match *referrerSource
+	matchLength := 0
+	for i, source := range referrerSources {
+		for _, pattern := range source.Hosts {
+			if len(pattern) > matchLength && matchesHost(host, pattern) {
+				match = &referrerSources[i]
+				matchLength = len(pattern)
+			}
+		}
+	}
+
+	if match == nil {
+		return host, ""
+	}
+	return match.Name, match.Category
+}
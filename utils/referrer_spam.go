@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"os"
+	"strings"
+	"sync"
+)
+
+//go:embed data/referrer_spam.txt
+var bundledReferrerSpamList []byte
+
+var (
+	referrerSpamMu      sync.RWMutex
+	referrerSpamDomains = parseReferrerSpamList(bundledReferrerSpamList)
+)
+
+// parseReferrerSpamList reads one domain per line, skipping blank lines and # comments
+func parseReferrerSpamList(list []byte) map[string]bool {
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.TrimPrefix(line, "www.")] = true
+	}
+	return domains
+}
+
+// LoadReferrerSpamList replaces the referrer spam list with the one in the given file, or with the bundled list if path is empty. It returns the number of domains loaded.
+func LoadReferrerSpamList(path string) (int, error) {
+	list := bundledReferrerSpamList
+	if path != "" {
+		var err error
+		list, err = os.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	domains := parseReferrerSpamList(list)
+
+	referrerSpamMu.Lock()
+	referrerSpamDomains = domains
+	referrerSpamMu.Unlock()
+
+	return len(domains), nil
+}
+
+// IsReferrerSpam reports whether the referrer host, or one of its parent domains, is on the referrer spam list
+func IsReferrerSpam(host string) bool {
+	host = strings.ToLower(host)
+
+	referrerSpamMu.RLock()
+	defer referrerSpamMu.RUnlock()
+
+	for host != "" {
+		if referrerSpamDomains[host] {
+			return true
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			return false
+		}
+		host = parent
+	}
+	return false
+}
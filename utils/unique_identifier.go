@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"sync"
 	"time"
 )
 
@@ -15,6 +16,9 @@ type dailySalt struct {
 // Stored in memory
 var dailySaltCache = make(map[string]dailySalt)
 
+// Guards dailySaltCache, the salt is requested concurrently by the handlers and the ingest queue workers
+var dailySaltMu sync.Mutex
+
 // getDailySalt generates a random 16-byte salt
 func getDailySalt() ([]byte, error) {
 	// Generate a random 16-byte salt
@@ -28,6 +32,9 @@ func getDailySalt() ([]byte, error) {
 
 // GenerateDailySalt generates a unique salt for the current day if it hasn't been generated yet.
 func GenerateDailySalt() ([]byte, error) {
+	dailySaltMu.Lock()
+	defer dailySaltMu.Unlock()
+
 	now := time.Now()
 	dateString := now.Format("2006-01-02")
 